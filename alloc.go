@@ -0,0 +1,141 @@
+package nfs
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/tchajed/go-nfs/balloc"
+)
+
+// allocator is an on-disk bitmap kept in memory for the life of an Fs
+//
+// A transaction changes bm in place while holding the allocator lock, so no
+// other transaction sees the changes before they commit. The transaction
+// remembers the changes so it can undo them if it aborts, and logs only the
+// bitmap blocks it dirtied when it commits.
+type allocator struct {
+	base uint64 // address of the first bitmap block
+	bm   *balloc.Bitmap
+}
+
+func openAllocator(log Log, base uint64, numBlocks uint64) *allocator {
+	bs := make([]disk.Block, numBlocks)
+	for k := range bs {
+		bs[k] = log.Read(base + uint64(k))
+	}
+	return &allocator{base: base, bm: balloc.Open(bs)}
+}
+
+// addr is the address of the bitmap block holding item off
+func (a *allocator) addr(off uint64) uint64 {
+	return a.base + off/balloc.ItemsPerBitmap
+}
+
+// block returns the current contents of the bitmap block at addr
+func (a *allocator) block(addr uint64) disk.Block {
+	return a.bm.Block(int(addr - a.base))
+}
+
+// allocChange is a run of n items a transaction allocated (or freed, if
+// !alloc)
+type allocChange struct {
+	a     *allocator
+	off   uint64
+	n     uint64
+	alloc bool
+}
+
+func (c allocChange) undo() {
+	if c.alloc {
+		c.a.bm.FreeRange(c.off, c.n)
+		return
+	}
+	for k := uint64(0); k < c.n; k++ {
+		c.a.bm.MarkUsed(c.off + k)
+	}
+}
+
+// txnBitmap is an allocator's bitmap as seen by a transaction
+type txnBitmap struct {
+	txn *txn
+	a   *allocator
+}
+
+func (fs Fs) blockAlloc(txn *txn) txnBitmap {
+	txn.lockAlloc()
+	return txnBitmap{txn: txn, a: fs.blockA}
+}
+
+func (fs Fs) inodeAlloc(txn *txn) txnBitmap {
+	txn.lockAlloc()
+	return txnBitmap{txn: txn, a: fs.inodeA}
+}
+
+// record notes a change to the n items starting at off (n > 0)
+func (bm txnBitmap) record(off uint64, n uint64, alloc bool) {
+	bm.txn.allocChanges = append(bm.txn.allocChanges,
+		allocChange{a: bm.a, off: off, n: n, alloc: alloc})
+	for addr := bm.a.addr(off); addr <= bm.a.addr(off+n-1); addr++ {
+		bm.txn.bitmaps[addr] = bm.a
+	}
+}
+
+// Alloc allocates an item, continuing from the last allocation
+//
+// boolean status is false if the allocator is full
+func (bm txnBitmap) Alloc() (uint64, bool) {
+	off, ok := bm.a.bm.Alloc()
+	if ok {
+		bm.record(off, 1, true)
+	}
+	return off, ok
+}
+
+// AllocNear allocates an item at or after hint if possible
+func (bm txnBitmap) AllocNear(hint uint64) (uint64, bool) {
+	off, ok := bm.a.bm.AllocNear(hint)
+	if ok {
+		bm.record(off, 1, true)
+	}
+	return off, ok
+}
+
+func (bm txnBitmap) Free(off uint64) {
+	bm.a.bm.Free(off)
+	bm.record(off, 1, false)
+}
+
+// AllocRange allocates n contiguous items, or the longest run there is if
+// there is no run of n
+//
+// returns the run's first item and its length, which is 0 if the allocator
+// is full
+func (bm txnBitmap) AllocRange(n uint64) (uint64, uint64) {
+	off, l := bm.a.bm.AllocRange(n)
+	if l > 0 {
+		bm.record(off, l, true)
+	}
+	return off, l
+}
+
+// AllocRangeNear is like AllocRange, but looks for a run at or after hint
+func (bm txnBitmap) AllocRangeNear(hint uint64, n uint64) (uint64, uint64) {
+	off, l := bm.a.bm.AllocRangeNear(hint, n)
+	if l > 0 {
+		bm.record(off, l, true)
+	}
+	return off, l
+}
+
+// FreeRange frees the n items starting at off
+func (bm txnBitmap) FreeRange(off uint64, n uint64) {
+	if n == 0 {
+		return
+	}
+	bm.a.bm.FreeRange(off, n)
+	bm.record(off, n, false)
+}
+
+// NumFree counts the items that are not allocated
+func (bm txnBitmap) NumFree() uint64 {
+	return bm.a.bm.NumFree()
+}
@@ -1,30 +1,72 @@
 package balloc
 
 import (
-	"github.com/tchajed/go-awol"
+	"encoding/binary"
+	"math/bits"
+
 	"github.com/tchajed/goose/machine/disk"
 )
 
 const ItemsPerBitmap = 4096 * 8
 
-type Bitmap []disk.Block
+const wordsPerBitmap = disk.BlockSize / 8
 
-func Init(blocks int) Bitmap {
-	bm := make(Bitmap, blocks)
+// Bitmap is an allocator backed by bitmap blocks
+//
+// Alongside the blocks, it tracks how many items are free in each block (so
+// full blocks are skipped without being scanned) and in total, and where the
+// last allocation was (so Alloc continues from there rather than from the
+// start).
+type Bitmap struct {
+	blocks  []disk.Block
+	free    []uint64
+	numFree uint64
+	next    uint64
+}
+
+func Init(blocks int) *Bitmap {
+	bs := make([]disk.Block, blocks)
 	for i := 0; i < blocks; i++ {
-		bm[i] = make(disk.Block, disk.BlockSize)
+		bs[i] = make(disk.Block, disk.BlockSize)
 	}
-	return bm
+	return Open(bs)
+}
+
+// Writer is where a bitmap is flushed to, such as an *awol.Op
+type Writer interface {
+	Write(a uint64, v disk.Block)
 }
 
-func (bm Bitmap) Flush(op *awol.Op, at uint64) {
-	for i, b := range bm {
+func (bm *Bitmap) Flush(op Writer, at uint64) {
+	for i, b := range bm.blocks {
 		op.Write(at+uint64(i), b)
 	}
 }
 
-func Open(bm []disk.Block) Bitmap {
-	return bm
+func Open(bs []disk.Block) *Bitmap {
+	free := make([]uint64, len(bs))
+	numFree := uint64(0)
+	for i, b := range bs {
+		for w := uint64(0); w < wordsPerBitmap; w++ {
+			free[i] += 64 - uint64(bits.OnesCount64(getWord(b, w)))
+		}
+		numFree += free[i]
+	}
+	return &Bitmap{blocks: bs, free: free, numFree: numFree}
+}
+
+// Block returns the ith block of the bitmap, which the caller must not
+// modify
+func (bm *Bitmap) Block(i int) disk.Block {
+	return bm.blocks[i]
+}
+
+func getWord(b disk.Block, w uint64) uint64 {
+	return binary.LittleEndian.Uint64(b[w*8 : w*8+8])
+}
+
+func putWord(b disk.Block, w uint64, x uint64) {
+	binary.LittleEndian.PutUint64(b[w*8:w*8+8], x)
 }
 
 // Free an item in a bitmap
@@ -33,38 +75,215 @@ func Open(bm []disk.Block) Bitmap {
 //
 // assumes off < bitmaps*ItemsPerBitmap
 // (off fits in the abstract size of the bitmap)
-func (bm Bitmap) Free(off uint64) {
+func (bm *Bitmap) Free(off uint64) {
+	blockIndex := off / ItemsPerBitmap
+	byteIndex := (off / 8) % 4096
+	bitIndex := off % 8
+	b := bm.blocks[blockIndex]
+	if b[byteIndex]&(1<<bitIndex) != 0 {
+		b[byteIndex] &= ^(1 << bitIndex)
+		bm.free[blockIndex]++
+		bm.numFree++
+	}
+}
+
+// MarkUsed marks an item as allocated, so Alloc never returns it
+//
+// modifies bm
+func (bm *Bitmap) MarkUsed(off uint64) {
 	blockIndex := off / ItemsPerBitmap
 	byteIndex := (off / 8) % 4096
 	bitIndex := off % 8
-	bm[blockIndex][byteIndex] = bm[blockIndex][byteIndex] & ^(1 << bitIndex)
+	b := bm.blocks[blockIndex]
+	if b[byteIndex]&(1<<bitIndex) == 0 {
+		b[byteIndex] |= 1 << bitIndex
+		bm.free[blockIndex]--
+		bm.numFree--
+	}
+}
+
+// setRange marks the n items starting at off as used (or free), a word at a
+// time
+func (bm *Bitmap) setRange(off uint64, n uint64, used bool) {
+	for n > 0 {
+		blockIndex := off / ItemsPerBitmap
+		w := (off % ItemsPerBitmap) / 64
+		bit := off % 64
+		k := 64 - bit
+		if k > n {
+			k = n
+		}
+		// k bits starting at bit
+		mask := ^uint64(0) >> (64 - k) << bit
+		b := bm.blocks[blockIndex]
+		word := getWord(b, w)
+		if used {
+			changed := uint64(bits.OnesCount64(mask &^ word))
+			bm.free[blockIndex] -= changed
+			bm.numFree -= changed
+			word |= mask
+		} else {
+			changed := uint64(bits.OnesCount64(mask & word))
+			bm.free[blockIndex] += changed
+			bm.numFree += changed
+			word &^= mask
+		}
+		putWord(b, w, word)
+		off += k
+		n -= k
+	}
+}
+
+func (bm *Bitmap) Size() uint64 {
+	return ItemsPerBitmap * uint64(len(bm.blocks))
+}
+
+// NumFree is the number of items that are not allocated
+func (bm *Bitmap) NumFree() uint64 {
+	return bm.numFree
+}
+
+// findFree finds the first free item in block b at or after bit start of the
+// block
+func findFree(b disk.Block, start uint64) (uint64, bool) {
+	for w := start / 64; w < wordsPerBitmap; w++ {
+		word := getWord(b, w)
+		if w == start/64 {
+			// treat the bits before start as used
+			word |= 1<<(start%64) - 1
+		}
+		if word != ^uint64(0) {
+			return w*64 + uint64(bits.TrailingZeros64(^word)), true
+		}
+	}
+	return 0, false
 }
 
-func (bm Bitmap) Size() uint64 {
-	return ItemsPerBitmap * uint64(len(bm))
+// nextFree finds the first free item in [from, end)
+func (bm *Bitmap) nextFree(from uint64, end uint64) (uint64, bool) {
+	for from < end {
+		blockIndex := from / ItemsPerBitmap
+		if bm.free[blockIndex] != 0 {
+			bit, ok := findFree(bm.blocks[blockIndex], from%ItemsPerBitmap)
+			if ok {
+				off := blockIndex*ItemsPerBitmap + bit
+				return off, off < end
+			}
+		}
+		from = (blockIndex + 1) * ItemsPerBitmap
+	}
+	return 0, false
+}
+
+// runLen is the number of free items starting at off, up to max
+func (bm *Bitmap) runLen(off uint64, max uint64) uint64 {
+	n := uint64(0)
+	for n < max && off+n < bm.Size() {
+		p := off + n
+		// the bits from p to the end of its word, where free bits are 0
+		word := getWord(bm.blocks[p/ItemsPerBitmap], (p%ItemsPerBitmap)/64) >> (p % 64)
+		if word != 0 {
+			n += uint64(bits.TrailingZeros64(word))
+			break
+		}
+		n += 64 - p%64
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// findRun finds the first run of n free items that starts in [from, end),
+// or failing that the longest run starting there
+func (bm *Bitmap) findRun(from uint64, end uint64, n uint64) (uint64, uint64) {
+	bestStart, bestLen := uint64(0), uint64(0)
+	for from < end {
+		start, ok := bm.nextFree(from, end)
+		if !ok {
+			break
+		}
+		l := bm.runLen(start, n)
+		if l > bestLen {
+			bestStart, bestLen = start, l
+			if l == n {
+				break
+			}
+		}
+		// the item after the run is in use
+		from = start + l + 1
+	}
+	return bestStart, bestLen
+}
+
+// allocRun allocates the first run of n items at or after start, wrapping
+// around to the beginning of the bitmap, or failing that the longest run
+//
+// returns the run's first item and length, which is 0 if the bitmap is full
+func (bm *Bitmap) allocRun(start uint64, n uint64) (uint64, uint64) {
+	if start >= bm.Size() {
+		start = 0
+	}
+	off, l := bm.findRun(start, bm.Size(), n)
+	if l < n {
+		off2, l2 := bm.findRun(0, start, n)
+		if l2 > l {
+			off, l = off2, l2
+		}
+	}
+	bm.setRange(off, l, true)
+	return off, l
+}
+
+// allocFrom allocates the first free item at or after start, wrapping around
+// to the beginning of the bitmap
+func (bm *Bitmap) allocFrom(start uint64) (uint64, bool) {
+	off, l := bm.allocRun(start, 1)
+	return off, l == 1
 }
 
 // Allocate an item in a bitmap
 //
-// modifies bm to mark the item allocated
+// modifies bm to mark the item allocated; searches from just after the last
+// item Alloc returned
 //
 // boolean status is false if allocator is full
-func (bm Bitmap) Alloc() (uint64, bool) {
-	for blockIndex := uint64(0); blockIndex < uint64(len(bm)); blockIndex++ {
-		b := bm[blockIndex]
-		for byteIndex := uint64(0); byteIndex < uint64(len(b)); byteIndex++ {
-			byteVal := b[byteIndex]
-			if byteVal == 0xff {
-				continue
-			}
-			for bitIndex := uint64(0); bitIndex < 8; bitIndex++ {
-				if byteVal&(1<<bitIndex) == 0 {
-					b[byteIndex] |= 1 << bitIndex
-					off := bitIndex + 8*byteIndex + ItemsPerBitmap*blockIndex
-					return off, true
-				}
-			}
-		}
+func (bm *Bitmap) Alloc() (uint64, bool) {
+	off, ok := bm.allocFrom(bm.next)
+	if ok {
+		bm.next = off + 1
 	}
-	return 0, false
+	return off, ok
+}
+
+// AllocNear allocates the first free item at or after hint, such as the item
+// just after one allocated earlier, to keep related items together
+//
+// if everything after hint is in use, searches from the start of the bitmap
+func (bm *Bitmap) AllocNear(hint uint64) (uint64, bool) {
+	return bm.allocFrom(hint)
+}
+
+// AllocRange allocates n contiguous items, continuing from the last
+// allocation like Alloc
+//
+// If there is no run of n free items, allocates the longest run there is
+// instead. Returns the first item of the run and its length, which is 0 if
+// the allocator is full.
+func (bm *Bitmap) AllocRange(n uint64) (uint64, uint64) {
+	off, l := bm.allocRun(bm.next, n)
+	if l > 0 {
+		bm.next = off + l
+	}
+	return off, l
+}
+
+// AllocRangeNear is like AllocRange, but searches from hint like AllocNear
+func (bm *Bitmap) AllocRangeNear(hint uint64, n uint64) (uint64, uint64) {
+	return bm.allocRun(hint, n)
+}
+
+// FreeRange frees the n items starting at off
+func (bm *Bitmap) FreeRange(off uint64, n uint64) {
+	bm.setRange(off, n, false)
 }
@@ -13,14 +13,21 @@ type BallocSuite struct {
 	log *awol.Log
 }
 
-func (suite *BallocSuite) fresh(alloc Bitmap) uint64 {
+func (suite *BallocSuite) fresh(alloc *Bitmap) uint64 {
 	suite.T().Helper()
 	key, ok := alloc.Alloc()
 	suite.Require().True(ok)
 	return key
 }
 
-func (suite *BallocSuite) full(alloc Bitmap) {
+func (suite *BallocSuite) near(alloc *Bitmap, hint uint64) uint64 {
+	suite.T().Helper()
+	key, ok := alloc.AllocNear(hint)
+	suite.Require().True(ok)
+	return key
+}
+
+func (suite *BallocSuite) full(alloc *Bitmap) {
 	suite.T().Helper()
 	key, ok := alloc.Alloc()
 	suite.False(ok, "allocator should be full but allocated %d", key)
@@ -76,12 +83,36 @@ func (suite *BallocSuite) TestFlushReopen() {
 		bs[i] = suite.log.Read(1 + i)
 	}
 	alloc = Open(bs)
-	// this is the only test that assumes identifiers are returned in order
+	// a freshly opened bitmap allocates from the start
 	suite.Equal(uint64(10), suite.fresh(alloc))
 	suite.Equal(uint64(22), suite.fresh(alloc))
 	alloc.Free(1000)
 }
 
+func (suite *BallocSuite) TestMarkUsed() {
+	alloc := Init(1)
+	for i := uint64(0); i < ItemsPerBitmap; i += 2 {
+		alloc.MarkUsed(i)
+	}
+	for i := 0; i < ItemsPerBitmap/2; i++ {
+		key := suite.fresh(alloc)
+		suite.Equal(uint64(1), key%2, "marked items should not be allocated")
+	}
+	suite.full(alloc)
+}
+
+func (suite *BallocSuite) TestNumFree() {
+	alloc := Init(2)
+	suite.Equal(uint64(2*ItemsPerBitmap), alloc.NumFree())
+	for i := 0; i < 10; i++ {
+		suite.fresh(alloc)
+	}
+	alloc.MarkUsed(ItemsPerBitmap + 3)
+	suite.Equal(uint64(2*ItemsPerBitmap-11), alloc.NumFree())
+	alloc.Free(ItemsPerBitmap + 3)
+	suite.Equal(uint64(2*ItemsPerBitmap-10), alloc.NumFree())
+}
+
 func BenchmarkAllocFree(b *testing.B) {
 	for benchIter := 0; benchIter < b.N; benchIter++ {
 		alloc := Init(3)
@@ -99,6 +130,175 @@ func BenchmarkAllocFree(b *testing.B) {
 	}
 }
 
+func (suite *BallocSuite) TestAllocContinues() {
+	alloc := Init(2)
+	key1 := suite.fresh(alloc)
+	alloc.Free(key1)
+	key2 := suite.fresh(alloc)
+	suite.Equal(key1+1, key2, "should continue after the last allocation")
+	for i := uint64(0); i < 2*ItemsPerBitmap-2; i++ {
+		suite.fresh(alloc)
+	}
+	suite.Equal(key1, suite.fresh(alloc), "should wrap around to free items")
+	suite.full(alloc)
+}
+
+func (suite *BallocSuite) TestAllocNear() {
+	alloc := Init(2)
+	suite.Equal(uint64(ItemsPerBitmap+5), suite.near(alloc, ItemsPerBitmap+5))
+	suite.Equal(uint64(ItemsPerBitmap+6), suite.near(alloc, ItemsPerBitmap+5))
+	alloc.MarkUsed(2*ItemsPerBitmap - 1)
+	suite.Equal(uint64(0), suite.near(alloc, 2*ItemsPerBitmap-1),
+		"should wrap around to the start")
+	suite.Equal(uint64(1), suite.near(alloc, 10*ItemsPerBitmap),
+		"out-of-range hint should start from the beginning")
+}
+
+func (suite *BallocSuite) TestOpenCounts() {
+	alloc := Init(2)
+	for i := uint64(0); i < ItemsPerBitmap; i++ {
+		alloc.MarkUsed(i)
+	}
+	alloc.MarkUsed(ItemsPerBitmap + 100)
+	alloc = Open([]disk.Block{alloc.Block(0), alloc.Block(1)})
+	suite.Equal(uint64(ItemsPerBitmap-1), alloc.NumFree())
+	suite.Equal(uint64(ItemsPerBitmap), suite.fresh(alloc),
+		"the full block should be skipped")
+	// freeing twice should not count twice
+	alloc.Free(ItemsPerBitmap + 100)
+	alloc.Free(ItemsPerBitmap + 100)
+	suite.Equal(uint64(ItemsPerBitmap-1), alloc.NumFree())
+}
+
+func (suite *BallocSuite) TestAllocRange() {
+	alloc := Init(2)
+	off, n := alloc.AllocRange(100)
+	suite.Equal(uint64(0), off)
+	suite.Equal(uint64(100), n)
+	off, n = alloc.AllocRange(100)
+	suite.Equal(uint64(100), off, "should continue after the last run")
+	suite.Equal(uint64(100), n)
+	suite.Equal(uint64(2*ItemsPerBitmap-200), alloc.NumFree())
+
+	// a run can cross words and blocks
+	off, n = alloc.AllocRangeNear(ItemsPerBitmap-10, 20)
+	suite.Equal(uint64(ItemsPerBitmap-10), off)
+	suite.Equal(uint64(20), n)
+	suite.Equal(uint64(ItemsPerBitmap+10), suite.near(alloc, ItemsPerBitmap-10))
+}
+
+func (suite *BallocSuite) TestAllocRangeSkipsShortRuns() {
+	alloc := Init(1)
+	// free runs of length 1, 2, 3, ... separated by used items
+	next := uint64(0)
+	for l := uint64(1); next < ItemsPerBitmap; l++ {
+		alloc.MarkUsed(next)
+		next += l + 1
+	}
+	// the first run of length 10 starts at 55, and the next at 66
+	free := alloc.NumFree()
+	off, n := alloc.AllocRangeNear(0, 10)
+	suite.Equal(uint64(55), off)
+	suite.Equal(uint64(10), n)
+	suite.Equal(free-10, alloc.NumFree())
+	off, _ = alloc.AllocRangeNear(0, 10)
+	suite.Equal(uint64(66), off)
+}
+
+func (suite *BallocSuite) TestAllocRangePartial() {
+	alloc := Init(1)
+	for i := uint64(0); i < ItemsPerBitmap; i++ {
+		alloc.MarkUsed(i)
+	}
+	alloc.FreeRange(100, 3)
+	alloc.FreeRange(200, 5)
+	alloc.FreeRange(300, 4)
+	off, n := alloc.AllocRange(10)
+	suite.Equal(uint64(200), off, "should get the longest run")
+	suite.Equal(uint64(5), n)
+	suite.Equal(uint64(7), alloc.NumFree())
+	alloc.FreeRange(200, 5)
+	suite.Equal(uint64(12), alloc.NumFree())
+	alloc.FreeRange(200, 5)
+	suite.Equal(uint64(12), alloc.NumFree(), "freeing twice should not count twice")
+
+	alloc.AllocRange(10)
+	alloc.AllocRange(10)
+	alloc.AllocRange(10)
+	_, n = alloc.AllocRange(10)
+	suite.Equal(uint64(0), n, "allocator should be full")
+}
+
+func (suite *BallocSuite) TestNumFreeMatchesBlocks() {
+	alloc := Init(2)
+	alloc.AllocRange(ItemsPerBitmap + 100)
+	alloc.FreeRange(50, 30)
+	alloc.Free(ItemsPerBitmap + 10)
+	alloc.MarkUsed(ItemsPerBitmap + 10)
+	alloc.MarkUsed(ItemsPerBitmap + 1000)
+	alloc.AllocNear(60)
+	reopened := Open(copyBlocks([]disk.Block{alloc.Block(0), alloc.Block(1)}))
+	suite.Equal(reopened.NumFree(), alloc.NumFree())
+}
+
+// mostlyFull returns the blocks of a bitmap with only every 100th item free
+func mostlyFull(blocks int) []disk.Block {
+	alloc := Init(blocks)
+	for i := uint64(0); i < alloc.Size(); i++ {
+		if i%100 != 99 {
+			alloc.MarkUsed(i)
+		}
+	}
+	var bs []disk.Block
+	for i := 0; i < blocks; i++ {
+		bs = append(bs, alloc.Block(i))
+	}
+	return bs
+}
+
+func copyBlocks(bs []disk.Block) []disk.Block {
+	var copies []disk.Block
+	for _, b := range bs {
+		copies = append(copies, append(disk.Block{}, b...))
+	}
+	return copies
+}
+
+// BenchmarkAllocMostlyFull allocates the remaining items of a mostly-full
+// bitmap
+func BenchmarkAllocMostlyFull(b *testing.B) {
+	bs := mostlyFull(8)
+	for benchIter := 0; benchIter < b.N; benchIter++ {
+		b.StopTimer()
+		alloc := Open(copyBlocks(bs))
+		b.StartTimer()
+		for {
+			if _, ok := alloc.Alloc(); !ok {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkAllocNearMostlyFull allocates the remaining items of a
+// mostly-full bitmap, each near the previous one
+func BenchmarkAllocNearMostlyFull(b *testing.B) {
+	bs := mostlyFull(8)
+	for benchIter := 0; benchIter < b.N; benchIter++ {
+		b.StopTimer()
+		alloc := Open(copyBlocks(bs))
+		b.StartTimer()
+		hint := uint64(0)
+		for {
+			off, ok := alloc.AllocNear(hint)
+			if !ok {
+				break
+			}
+			hint = off + 1
+		}
+	}
+}
+
 func TestBalloc(t *testing.T) {
 	suite.Run(t, new(BallocSuite))
 }
@@ -1,35 +1,108 @@
 package nfs
 
 import (
+	"github.com/tchajed/goose/machine"
 	"github.com/tchajed/goose/machine/disk"
-
-	"github.com/tchajed/go-nfs/marshal"
 )
 
-const MaxNameLen = 4096 - 1 - 8
+// directory blocks are packed with variable-length records, which together
+// cover the whole block:
+//
+// [ I (8 bytes) | RecLen, NameLen (8 bytes) | Name (padded to 8 bytes) ]
+//
+// A record with I == 0 is free space. An entry can use the space left over at
+// the end of a record (after its name), and removing an entry merges its
+// record into the previous one, so the space is reused by later entries.
+
+const dirEntHeader = 16
+
+const MaxNameLen = 4096 - dirEntHeader
+
+type dirEnt struct {
+	I      Inum // 0 for free space
+	Name   string
+	Off    uint64 // offset of the record within its block
+	RecLen uint64
+}
+
+// dirEntSize is the space needed for an entry with this name
+func dirEntSize(name string) uint64 {
+	return dirEntHeader + divUp(uint64(len(name)), 8)*8
+}
 
-type DirEnt struct {
-	Valid bool
-	Name  string // max 4096-1-8=4087 bytes
-	I     Inum
+func newDirBlock() disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	putDirEnt(b, dirEnt{I: 0, Name: "", Off: 0, RecLen: disk.BlockSize})
+	return b
 }
 
-func encodeDirEnt(de *DirEnt) disk.Block {
-	if len(de.Name) > MaxNameLen {
+func putDirEnt(b disk.Block, de dirEnt) {
+	if uint64(len(de.Name)) > de.RecLen-dirEntHeader {
 		panic("directory entry name too long")
 	}
-	enc := marshal.NewEnc()
-	enc.PutString(de.Name)
-	enc.PutBool(de.Valid)
-	enc.PutInt(de.I)
-	return enc.Finish()
+	machine.UInt64Put(b[de.Off:de.Off+8], de.I)
+	machine.UInt64Put(b[de.Off+8:de.Off+16], de.RecLen|uint64(len(de.Name))<<32)
+	copy(b[de.Off+dirEntHeader:], de.Name)
 }
 
-func decodeDirEnt(b disk.Block) *DirEnt {
-	dec := marshal.NewDec(b)
-	de := &DirEnt{}
-	de.Name = dec.GetString()
-	de.Valid = dec.GetBool()
-	de.I = dec.GetInt()
-	return de
+// decodeDirBlock returns all of the records in a directory block
+func decodeDirBlock(b disk.Block) []dirEnt {
+	var ents []dirEnt
+	for off := uint64(0); off < disk.BlockSize; {
+		i := machine.UInt64Get(b[off : off+8])
+		lens := machine.UInt64Get(b[off+8 : off+16])
+		recLen := lens & (1<<32 - 1)
+		nameLen := lens >> 32
+		if recLen < dirEntHeader || off+recLen > disk.BlockSize ||
+			nameLen > recLen-dirEntHeader {
+			panic("corrupt directory block")
+		}
+		name := string(b[off+dirEntHeader : off+dirEntHeader+nameLen])
+		ents = append(ents, dirEnt{I: i, Name: name, Off: off, RecLen: recLen})
+		off += recLen
+	}
+	return ents
+}
+
+// addDirEnt adds an entry for name to b, if there is room
+func addDirEnt(b disk.Block, name string, i Inum) bool {
+	need := dirEntSize(name)
+	for _, de := range decodeDirBlock(b) {
+		if de.I == 0 {
+			if de.RecLen >= need {
+				putDirEnt(b, dirEnt{I: i, Name: name, Off: de.Off, RecLen: de.RecLen})
+				return true
+			}
+			continue
+		}
+		used := dirEntSize(de.Name)
+		if de.RecLen-used >= need {
+			// split de, giving the unused space to the new entry
+			de2 := dirEnt{I: i, Name: name, Off: de.Off + used, RecLen: de.RecLen - used}
+			de.RecLen = used
+			putDirEnt(b, de)
+			putDirEnt(b, de2)
+			return true
+		}
+	}
+	return false
+}
+
+// removeDirEnt removes the entry for name from b, if it is there
+func removeDirEnt(b disk.Block, name string) bool {
+	ents := decodeDirBlock(b)
+	for k, de := range ents {
+		if de.I == 0 || de.Name != name {
+			continue
+		}
+		if k == 0 {
+			putDirEnt(b, dirEnt{I: 0, Name: "", Off: 0, RecLen: de.RecLen})
+		} else {
+			prev := ents[k-1]
+			prev.RecLen += de.RecLen
+			putDirEnt(b, prev)
+		}
+		return true
+	}
+	return false
 }
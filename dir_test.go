@@ -0,0 +1,86 @@
+package nfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dirBlockNames(b []byte) []string {
+	var names []string
+	for _, de := range decodeDirBlock(b) {
+		if de.I != 0 {
+			names = append(names, de.Name)
+		}
+	}
+	return names
+}
+
+func TestDirBlock(t *testing.T) {
+	assert := assert.New(t)
+	b := newDirBlock()
+	assert.Empty(dirBlockNames(b))
+	var names []string
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if !addDirEnt(b, name, Inum(i+1)) {
+			break
+		}
+		names = append(names, name)
+	}
+	// each entry takes 24 bytes
+	assert.Equal(4096/24, len(names))
+	assert.Equal(names, dirBlockNames(b))
+
+	assert.True(removeDirEnt(b, "file0"))
+	assert.True(removeDirEnt(b, "file5"))
+	assert.False(removeDirEnt(b, "file5"))
+	assert.True(addDirEnt(b, "new0", 100), "should reuse space")
+	assert.True(addDirEnt(b, "new5", 101), "should reuse space")
+	assert.False(addDirEnt(b, "new", 102))
+	assert.Equal("new0", dirBlockNames(b)[0])
+	assert.Equal("new5", dirBlockNames(b)[5])
+
+	// a long name needs several adjacent free records
+	assert.True(removeDirEnt(b, "file10"))
+	assert.False(addDirEnt(b, "a_longer_file_name", 103))
+	assert.True(removeDirEnt(b, "file11"))
+	assert.True(addDirEnt(b, "a_longer_file_name", 103))
+}
+
+func TestDirMaxName(t *testing.T) {
+	assert := assert.New(t)
+	b := newDirBlock()
+	name := string(make([]byte, MaxNameLen))
+	assert.True(addDirEnt(b, name, 1))
+	assert.Equal([]string{name}, dirBlockNames(b))
+}
+
+func TestDxNode(t *testing.T) {
+	assert := assert.New(t)
+	n := &dxNode{Levels: 2}
+	for k := uint64(0); k < dxMaxEntries; k++ {
+		n.Entries = append(n.Entries, dxEntry{Hash: k * 10, Block: k + 1})
+	}
+	b := encodeDxNode(n)
+	assert.Empty(dirBlockNames(b), "index blocks should look empty")
+	assert.Equal(n, decodeDxNode(b))
+
+	assert.Equal(0, n.find(0))
+	assert.Equal(0, n.find(9))
+	assert.Equal(1, n.find(10))
+	assert.Equal(int(dxMaxEntries-1), n.find(1<<63))
+}
+
+func TestSplitHash(t *testing.T) {
+	assert := assert.New(t)
+	h, ok := splitHash([]uint64{1, 2, 3, 4})
+	assert.True(ok)
+	assert.Equal(uint64(3), h)
+	h, ok = splitHash([]uint64{1, 1, 1, 4})
+	assert.True(ok)
+	assert.Equal(uint64(4), h)
+	_, ok = splitHash([]uint64{5, 5})
+	assert.False(ok)
+}
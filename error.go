@@ -0,0 +1,78 @@
+package nfs
+
+import "fmt"
+
+// Error explains why a file-system operation failed
+//
+// The values are the NFS version 3 status codes (nfsstat3 in RFC 1813), so
+// an Error can be sent to clients as-is.
+type Error uint32
+
+const (
+	ErrPerm        Error = 1
+	ErrNoEnt       Error = 2
+	ErrIO          Error = 5
+	ErrNxio        Error = 6
+	ErrAcces       Error = 13
+	ErrExist       Error = 17
+	ErrXdev        Error = 18
+	ErrNoDev       Error = 19
+	ErrNotDir      Error = 20
+	ErrIsDir       Error = 21
+	ErrInval       Error = 22
+	ErrFBig        Error = 27
+	ErrNoSpc       Error = 28
+	ErrRoFs        Error = 30
+	ErrMLink       Error = 31
+	ErrNameTooLong Error = 63
+	ErrNotEmpty    Error = 66
+	ErrDQuot       Error = 69
+	ErrStale       Error = 70
+	ErrRemote      Error = 71
+	ErrBadHandle   Error = 10001
+	ErrNotSync     Error = 10002
+	ErrBadCookie   Error = 10003
+	ErrNotSupp     Error = 10004
+	ErrTooSmall    Error = 10005
+	ErrServerFault Error = 10006
+	ErrBadType     Error = 10007
+	ErrJukebox     Error = 10008
+)
+
+var errorNames = map[Error]string{
+	ErrPerm:        "not owner",
+	ErrNoEnt:       "no such file or directory",
+	ErrIO:          "I/O error",
+	ErrNxio:        "no such device or address",
+	ErrAcces:       "permission denied",
+	ErrExist:       "file exists",
+	ErrXdev:        "cross-device link",
+	ErrNoDev:       "no such device",
+	ErrNotDir:      "not a directory",
+	ErrIsDir:       "is a directory",
+	ErrInval:       "invalid argument",
+	ErrFBig:        "file too large",
+	ErrNoSpc:       "no space left on device",
+	ErrRoFs:        "read-only file system",
+	ErrMLink:       "too many hard links",
+	ErrNameTooLong: "file name too long",
+	ErrNotEmpty:    "directory not empty",
+	ErrDQuot:       "quota exceeded",
+	ErrStale:       "stale file handle",
+	ErrRemote:      "too many levels of remote in path",
+	ErrBadHandle:   "illegal file handle",
+	ErrNotSync:     "update synchronization mismatch",
+	ErrBadCookie:   "bad readdir cookie",
+	ErrNotSupp:     "operation not supported",
+	ErrTooSmall:    "buffer or request too small",
+	ErrServerFault: "server fault",
+	ErrBadType:     "type not supported",
+	ErrJukebox:     "request in progress",
+}
+
+func (e Error) Error() string {
+	if s, ok := errorNames[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("nfs error %d", uint32(e))
+}
@@ -0,0 +1,228 @@
+package nfs
+
+import (
+	"bytes"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/tchajed/go-nfs/marshal"
+)
+
+// An inode using extents holds its first numExtents extents itself. The rest
+// go in a chain of extent blocks, extentsPerBlock to a block, each of which
+// starts with the address of the next (or 0 for the last); the inode holds
+// the address of the first. getInode reads the whole chain, so ino.Extents is
+// always the complete list.
+
+// extentsPerBlock is how many extents fit in an extent block after its link
+// to the next
+const extentsPerBlock = (4096/8 - 1) / 3
+
+func encodeExtentBlock(next Bnum, extents []extent) disk.Block {
+	enc := marshal.NewEnc()
+	enc.PutInt(next)
+	// unused extents are left as zeroes
+	for _, e := range extents {
+		enc.PutInt(e.Off)
+		enc.PutInt(e.Start)
+		enc.PutInt(e.Len)
+	}
+	return enc.Finish()
+}
+
+func decodeExtentBlock(b disk.Block) (Bnum, []extent) {
+	dec := marshal.NewDec(b)
+	next := dec.GetInt()
+	var extents []extent
+	for i := 0; i < extentsPerBlock; i++ {
+		e := extent{Off: dec.GetInt(), Start: dec.GetInt(), Len: dec.GetInt()}
+		if e.Len == 0 {
+			break
+		}
+		extents = append(extents, e)
+	}
+	return next, extents
+}
+
+// readExtentBlocks reads the chain of extent blocks starting at the one
+// decodeInode found, adding their extents to ino
+func (fs Fs) readExtentBlocks(txn *txn, ino *inode) {
+	bn := ino.ExtentBlocks[0]
+	ino.ExtentBlocks = nil
+	for bn != 0 {
+		ino.ExtentBlocks = append(ino.ExtentBlocks, bn)
+		next, extents := decodeExtentBlock(txn.Read(fs.blockAddr(bn)))
+		ino.Extents = append(ino.Extents, extents...)
+		bn = next
+	}
+}
+
+// extentBlocksFor is how many extent blocks an inode with n extents needs
+func extentBlocksFor(n int) int {
+	if n <= numExtents {
+		return 0
+	}
+	return (n - numExtents + extentsPerBlock - 1) / extentsPerBlock
+}
+
+// fitExtentBlocks allocates or frees extent blocks so that ino has as many
+// as its extents need
+//
+// the caller must flush ino
+func (fs Fs) fitExtentBlocks(txn *txn, blockA txnBitmap, ino *inode) error {
+	need := extentBlocksFor(len(ino.Extents))
+	for len(ino.ExtentBlocks) < need {
+		bn, err := fs.allocBlock(txn, blockA, 0)
+		if err != nil {
+			return err
+		}
+		ino.ExtentBlocks = append(ino.ExtentBlocks, bn)
+	}
+	for _, bn := range ino.ExtentBlocks[need:] {
+		blockA.Free(bn)
+	}
+	ino.ExtentBlocks = ino.ExtentBlocks[:need]
+	return nil
+}
+
+// flushExtentBlocks writes the extent blocks of ino whose contents changed
+func (fs Fs) flushExtentBlocks(txn *txn, ino *inode) {
+	if len(ino.ExtentBlocks) != extentBlocksFor(len(ino.Extents)) {
+		panic("extent blocks do not fit the extents")
+	}
+	for k, bn := range ino.ExtentBlocks {
+		var next Bnum
+		if k+1 < len(ino.ExtentBlocks) {
+			next = ino.ExtentBlocks[k+1]
+		}
+		start := numExtents + k*extentsPerBlock
+		end := start + extentsPerBlock
+		if end > len(ino.Extents) {
+			end = len(ino.Extents)
+		}
+		b := encodeExtentBlock(next, ino.Extents[start:end])
+		if !bytes.Equal(b, txn.Read(fs.blockAddr(bn))) {
+			txn.Write(fs.blockAddr(bn), b)
+		}
+	}
+}
+
+// lookupExtent finds the block for offset boff in an inode using extents
+//
+// returns the block and the number of blocks from there to the end of its
+// extent, which are contiguous on disk; if boff is in a hole, returns 0 and
+// the number of blocks until the next extent
+func (ino *inode) lookupExtent(boff uint64) (Bnum, uint64) {
+	for _, e := range ino.Extents {
+		if boff < e.Off {
+			return 0, e.Off - boff
+		}
+		if boff < e.Off+e.Len {
+			return e.Start + (boff - e.Off), e.Off + e.Len - boff
+		}
+	}
+	return 0, MaxFileBlocks - boff
+}
+
+// addExtent maps the blocks of e into an inode using extents
+//
+// e's offsets must be in a hole; if e is adjacent to an extent both in the
+// file and on disk it extends that extent (and may join it to the next one)
+//
+// the caller must fit ino's extent blocks and flush ino
+func (ino *inode) addExtent(e extent) {
+	// e goes between Extents[k-1] and Extents[k]
+	k := 0
+	for k < len(ino.Extents) && ino.Extents[k].Off < e.Off {
+		k++
+	}
+	if k > 0 {
+		prev := &ino.Extents[k-1]
+		if prev.Off+prev.Len > e.Off {
+			panic("block is already allocated")
+		}
+		if prev.Off+prev.Len == e.Off && prev.Start+prev.Len == e.Start {
+			prev.Len += e.Len
+			if k < len(ino.Extents) {
+				next := ino.Extents[k]
+				if next.Off == e.Off+e.Len && next.Start == e.Start+e.Len {
+					prev.Len += next.Len
+					ino.Extents = append(ino.Extents[:k], ino.Extents[k+1:]...)
+				}
+			}
+			return
+		}
+	}
+	if k < len(ino.Extents) {
+		next := &ino.Extents[k]
+		if next.Off == e.Off+e.Len && next.Start == e.Start+e.Len {
+			next.Off = e.Off
+			next.Start = e.Start
+			next.Len += e.Len
+			return
+		}
+	}
+	ino.Extents = append(ino.Extents, extent{})
+	copy(ino.Extents[k+1:], ino.Extents[k:])
+	ino.Extents[k] = e
+}
+
+// freeExtentBlocks frees all of the blocks for offsets keep and beyond in an
+// inode using extents, along with the extent blocks it no longer needs
+//
+// the caller must flush ino
+func (fs Fs) freeExtentBlocks(txn *txn, blockA txnBitmap, ino *inode, keep uint64) {
+	var extents []extent
+	for _, e := range ino.Extents {
+		newLen := e.Len
+		if e.Off+e.Len > keep {
+			newLen = 0
+			if e.Off < keep {
+				newLen = keep - e.Off
+			}
+		}
+		blockA.FreeRange(e.Start+newLen, e.Len-newLen)
+		if newLen > 0 {
+			e.Len = newLen
+			extents = append(extents, e)
+		}
+	}
+	ino.Extents = extents
+	if err := fs.fitExtentBlocks(txn, blockA, ino); err != nil {
+		panic("fewer extents should not need more extent blocks")
+	}
+}
+
+// freeExtentTail is freeInodeTail for an inode using extents
+func (fs Fs) freeExtentTail(txn *txn, blockA txnBitmap,
+	ino *inode, keep uint64, max uint64) uint64 {
+	for len(ino.Extents) > 0 && max > 0 {
+		e := &ino.Extents[len(ino.Extents)-1]
+		if e.Off+e.Len <= keep {
+			break
+		}
+		n := e.Off + e.Len - keep
+		if n > e.Len {
+			n = e.Len
+		}
+		if n > max {
+			n = max
+		}
+		e.Len -= n
+		blockA.FreeRange(e.Start+e.Len, n)
+		max -= n
+		if e.Len == 0 {
+			ino.Extents = ino.Extents[:len(ino.Extents)-1]
+		}
+	}
+	if err := fs.fitExtentBlocks(txn, blockA, ino); err != nil {
+		panic("fewer extents should not need more extent blocks")
+	}
+	if len(ino.Extents) > 0 {
+		last := ino.Extents[len(ino.Extents)-1]
+		if last.Off+last.Len > keep {
+			return last.Off + last.Len
+		}
+	}
+	return keep
+}
@@ -1,25 +1,32 @@
 package nfs
 
 import (
-	"fmt"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/tchajed/go-awol"
 	"github.com/tchajed/goose/machine/disk"
 
 	"github.com/tchajed/go-nfs/balloc"
+	"github.com/tchajed/go-nfs/lockmap"
 	"github.com/tchajed/go-nfs/marshal"
 )
 
 // file-system layout (on top of logical disk exposed by log):
-// [ superblock | block bitmaps | inodes | data blocks ]
+// [ superblock | inode bitmaps | block bitmaps | inodes | data blocks ]
 
 type SuperBlock struct {
 	// serialized
 	NumInodes       uint64
+	NumInodeBitmaps uint64
 	NumBlockBitmaps uint64
+	// identifies this file system in file handles
+	FsId uint64
+	// optional on-disk format features (the Feature constants)
+	Features uint64
 
 	// in-memory
+	inodeAllocBase uint64
 	blockAllocBase uint64
 	rootInode      Inum
 	inodeBase      uint64
@@ -28,8 +35,13 @@ type SuperBlock struct {
 	fsSize         uint64
 }
 
+// FeatureExtents stores file blocks as a list of extents in each inode,
+// rather than block pointers and indirect blocks
+const FeatureExtents uint64 = 1 << 0
+
 func (sb *SuperBlock) computeFields() {
-	sb.blockAllocBase = 1
+	sb.inodeAllocBase = 1
+	sb.blockAllocBase = sb.inodeAllocBase + sb.NumInodeBitmaps
 	sb.rootInode = 1
 	sb.inodeBase = sb.blockAllocBase + sb.NumBlockBitmaps
 	sb.numInodes = sb.NumInodes
@@ -37,21 +49,30 @@ func (sb *SuperBlock) computeFields() {
 	sb.fsSize = sb.dataBase + balloc.ItemsPerBitmap*sb.NumBlockBitmaps
 }
 
+func (sb *SuperBlock) hasExtents() bool {
+	return sb.Features&FeatureExtents != 0
+}
+
 // x/k, rounded up
 func divUp(x uint64, k uint64) uint64 {
 	return (x + (k - 1)) / k
 }
 
-func NewSuperBlock(diskSize uint64) *SuperBlock {
+func NewSuperBlock(diskSize uint64, features uint64) *SuperBlock {
 	// this isn't the precise threshold
 	if diskSize < 10 {
 		panic("disk too small")
 	}
 	numInodes := (diskSize - 1 - 1) / 4
-	blockBitmaps := divUp(diskSize-1-numInodes, balloc.ItemsPerBitmap)
+	// inode bitmaps are indexed by Inum, including the invalid Inum 0
+	inodeBitmaps := divUp(numInodes+1, balloc.ItemsPerBitmap)
+	blockBitmaps := divUp(diskSize-1-inodeBitmaps-numInodes, balloc.ItemsPerBitmap)
 	sb := &SuperBlock{
 		NumInodes:       numInodes,
+		NumInodeBitmaps: inodeBitmaps,
 		NumBlockBitmaps: blockBitmaps,
+		FsId:            uint64(time.Now().UnixNano()),
+		Features:        features,
 	}
 	sb.computeFields()
 	return sb
@@ -60,7 +81,10 @@ func NewSuperBlock(diskSize uint64) *SuperBlock {
 func encodeSuperBlock(sb *SuperBlock) disk.Block {
 	enc := marshal.NewEnc()
 	enc.PutInt(sb.NumInodes)
+	enc.PutInt(sb.NumInodeBitmaps)
 	enc.PutInt(sb.NumBlockBitmaps)
+	enc.PutInt(sb.FsId)
+	enc.PutInt(sb.Features)
 	return enc.Finish()
 }
 
@@ -68,7 +92,10 @@ func decodeSuperBlock(b disk.Block) *SuperBlock {
 	sb := new(SuperBlock)
 	dec := marshal.NewDec(b)
 	sb.NumInodes = dec.GetInt()
+	sb.NumInodeBitmaps = dec.GetInt()
 	sb.NumBlockBitmaps = dec.GetInt()
+	sb.FsId = dec.GetInt()
+	sb.Features = dec.GetInt()
 	sb.computeFields()
 	return sb
 }
@@ -81,23 +108,77 @@ type Log interface {
 	Apply()
 }
 
+// RangeLog is a Log that can also read n consecutive blocks starting at a
+// with a single request
+//
+// Reads of files use ReadRange for runs of blocks that are contiguous on
+// disk, as extents are, if the Log provides it.
+type RangeLog interface {
+	Log
+	ReadRange(a uint64, n uint64) []disk.Block
+}
+
+// readRange reads the n blocks starting at a from log, in one request if
+// log supports it
+func readRange(log Log, a uint64, n uint64) []disk.Block {
+	if l, ok := log.(RangeLog); ok {
+		return l.ReadRange(a, n)
+	}
+	bs := make([]disk.Block, n)
+	for k := range bs {
+		bs[k] = log.Read(a + uint64(k))
+	}
+	return bs
+}
+
+// Fs is a file system, which is safe to use from multiple goroutines
 type Fs struct {
-	log Log
-	sb  *SuperBlock
+	log    Log
+	sb     *SuperBlock
+	locks  *lockmap.LockMap
+	blockA *allocator
+	inodeA *allocator
 }
 
 func NewFs(log Log) Fs {
-	sb := NewSuperBlock(uint64(log.Size()))
+	return NewFsWithFeatures(log, 0)
+}
+
+// NewFsWithFeatures creates a file system using the optional features in
+// features (a combination of the Feature constants)
+func NewFsWithFeatures(log Log, features uint64) Fs {
+	diskSize := uint64(log.Size())
+	sb := NewSuperBlock(diskSize, features)
 	blockA := balloc.Init(int(sb.NumBlockBitmaps))
+	// 0 is an invalid Bnum, and the bitmap covers more blocks than the disk
+	// holds
+	blockA.MarkUsed(0)
+	for bn := diskSize - sb.dataBase + 1; bn < blockA.Size(); bn++ {
+		blockA.MarkUsed(bn)
+	}
+
+	inodeA := balloc.Init(int(sb.NumInodeBitmaps))
+	// as with blocks, 0 is an invalid Inum and the bitmap covers more inodes
+	// than there are; the root is allocated below
+	inodeA.MarkUsed(0)
+	inodeA.MarkUsed(sb.rootInode)
+	for i := sb.numInodes + 1; i < inodeA.Size(); i++ {
+		inodeA.MarkUsed(i)
+	}
 
 	op := log.Begin()
 	op.Write(0, encodeSuperBlock(sb))
+	inodeA.Flush(op, sb.inodeAllocBase)
 	blockA.Flush(op, sb.blockAllocBase)
 	log.Commit(op)
 
 	op = log.Begin()
-	op.Write(sb.inodeBase+(sb.rootInode-1),
-		encodeInode(newInode(INODE_KIND_DIR)))
+	root := newInode(INODE_KIND_DIR)
+	root.extents = sb.hasExtents()
+	root.init(INODE_KIND_DIR, 0755, now())
+	root.Nlink = 2
+	root.Parent = sb.rootInode
+	op.Write(sb.inodeBase+(sb.rootInode-1), encodeInode(root))
 	log.Commit(op)
 
 	freeInode := encodeInode(newInode(INODE_KIND_FREE))
@@ -106,42 +187,47 @@ func NewFs(log Log) Fs {
 		op.Write(sb.inodeBase+(i-1), freeInode)
 		log.Commit(op)
 	}
-	return Fs{log: log, sb: sb}
+	return Fs{log: log, sb: sb, locks: lockmap.New(),
+		blockA: &allocator{base: sb.blockAllocBase, bm: blockA},
+		inodeA: &allocator{base: sb.inodeAllocBase, bm: inodeA},
+	}
 }
 
 func OpenFs(log Log) Fs {
 	sb := decodeSuperBlock(log.Read(0))
-	return Fs{log: log, sb: sb}
+	return Fs{log: log, sb: sb, locks: lockmap.New(),
+		blockA: openAllocator(log, sb.blockAllocBase, sb.NumBlockBitmaps),
+		inodeA: openAllocator(log, sb.inodeAllocBase, sb.NumInodeBitmaps),
+	}
 }
 
-func (fs Fs) readBalloc() balloc.Bitmap {
-	bs := make([]disk.Block, fs.sb.NumBlockBitmaps)
-	for i := 0; i < len(bs); i++ {
-		bs[i] = fs.log.Read(fs.sb.blockAllocBase + uint64(i))
+// inodeRead reads block boff of ino, which is all zeroes in a hole
+func (fs Fs) inodeRead(txn *txn, ino *inode, boff uint64) disk.Block {
+	bn := fs.btoa(txn, ino, boff)
+	if bn == 0 {
+		return make(disk.Block, disk.BlockSize)
 	}
-	return balloc.Open(bs)
+	return txn.Read(fs.blockAddr(bn))
 }
 
-func (fs Fs) flushBalloc(op *awol.Op, bm balloc.Bitmap) {
-	bm.Flush(op, fs.sb.blockAllocBase)
+// inodeWrite writes block boff of ino, which must already be allocated
+func (fs Fs) inodeWrite(txn *txn, ino *inode, boff uint64, b disk.Block) {
+	bn := fs.btoa(txn, ino, boff)
+	if bn == 0 {
+		panic("write to a hole")
+	}
+	txn.Write(fs.blockAddr(bn), b)
 }
 
-// btoa translates an offset in an inode to a block number
+// inodeWriteAlloc writes block boff of ino, allocating it if it is in a hole
 //
-// does not depend on the rest of the disk because there are no indirect blocks
-func (ino inode) btoa(boff uint64) Bnum {
-	if boff >= uint64(len(ino.Direct)) {
-		panic("invalid block offset")
+// the caller must flush ino
+func (fs Fs) inodeWriteAlloc(txn *txn, ino *inode, boff uint64, b disk.Block) error {
+	if err := fs.allocInodeRange(txn, ino, boff, 1); err != nil {
+		return err
 	}
-	return ino.Direct[boff]
-}
-
-func (fs Fs) inodeRead(ino *inode, boff uint64) disk.Block {
-	return fs.log.Read(fs.sb.dataBase + ino.btoa(boff) - 1)
-}
-
-func (fs Fs) inodeWrite(op *awol.Op, ino *inode, boff uint64, b disk.Block) {
-	op.Write(fs.sb.dataBase+ino.btoa(boff)-1, b)
+	fs.inodeWrite(txn, ino, boff, b)
+	return nil
 }
 
 func (fs Fs) checkInode(i Inum) {
@@ -153,358 +239,1307 @@ func (fs Fs) checkInode(i Inum) {
 	}
 }
 
-func (fs Fs) getInode(i Inum) *inode {
+func (fs Fs) getInode(txn *txn, i Inum) *inode {
 	fs.checkInode(i)
-	b := fs.log.Read(fs.sb.inodeBase + (i - 1))
+	b := txn.Read(fs.sb.inodeBase + (i - 1))
 	ino := new(inode)
-	*ino = decodeInode(b)
+	*ino = decodeInode(b, fs.sb.hasExtents())
+	if len(ino.ExtentBlocks) > 0 {
+		fs.readExtentBlocks(txn, ino)
+	}
 	return ino
 }
 
-func (fs Fs) findFreeInode() (Inum, *inode) {
-	for i := uint64(1); i <= fs.sb.numInodes; i++ {
-		ino := fs.getInode(i)
-		if ino.Kind == INODE_KIND_FREE {
-			return i, ino
-		}
+// findFreeInode allocates an inode from the inode bitmap
+//
+// returns 0 if there are no free inodes
+func (fs Fs) findFreeInode(txn *txn) (Inum, *inode) {
+	// reuse the lowest free inode number
+	i, ok := fs.inodeAlloc(txn).AllocNear(0)
+	if !ok {
+		return 0, nil
+	}
+	ino := fs.getInode(txn, i)
+	if ino.Kind != INODE_KIND_FREE {
+		panic("inode bitmap out of sync with inodes")
 	}
-	return 0, nil
+	return i, ino
 }
 
-func (fs Fs) flushInode(op *awol.Op, i Inum, ino *inode) {
-	op.Write(fs.sb.inodeBase+(i-1), encodeInode(*ino))
+func (fs Fs) flushInode(txn *txn, i Inum, ino *inode) {
+	txn.Write(fs.sb.inodeBase+(i-1), encodeInode(*ino))
+	if ino.extents {
+		fs.flushExtentBlocks(txn, ino)
+	}
 }
 
-// returns false if grow failed (eg, due to inode size or running out of blocks)
-func (fs Fs) growInode(op *awol.Op, ino *inode, newLen uint64) bool {
+// freeInode marks i as free and frees its blocks
+//
+// bumps the generation number so that existing handles to i become stale
+func (fs Fs) freeInode(txn *txn, i Inum, ino *inode) {
+	if ino.Kind != INODE_KIND_SYMLINK {
+		fs.freeInodeBlocks(txn, fs.blockAlloc(txn), ino, 0)
+	}
+	free := newInode(INODE_KIND_FREE)
+	free.Gen = ino.Gen + 1
+	fs.flushInode(txn, i, &free)
+	fs.inodeAlloc(txn).Free(i)
+}
+
+// unlinkInode accounts for removing an entry in dir pointing to i
+//
+// frees i when no links to it remain; the caller must flush dir
+func (fs Fs) unlinkInode(txn *txn, dir *inode, i Inum, ino *inode, t Time) {
+	if ino.Kind == INODE_KIND_DIR {
+		// directories have only one entry, and their ".." no longer refers
+		// to dir
+		dir.Nlink--
+		fs.freeInode(txn, i, ino)
+		return
+	}
+	ino.Nlink--
+	if ino.Nlink == 0 {
+		fs.freeInode(txn, i, ino)
+	} else {
+		ino.Ctime = t
+		fs.flushInode(txn, i, ino)
+	}
+}
+
+// growInode extends ino to newLen bytes
+//
+// the new part of the file is a hole, so no blocks are allocated until it is
+// written
+//
+// returns ErrFBig if the inode cannot be that large
+func (fs Fs) growInode(ino *inode, newLen uint64) error {
 	if !(ino.NBytes <= newLen) {
 		panic("growInode requires a larger length")
 	}
-	oldBlks := divUp(ino.NBytes, disk.BlockSize)
-	newBlks := divUp(newLen, disk.BlockSize)
-	if newBlks > NumDirect {
-		return false
-	}
-	blockA := fs.readBalloc()
-	for b := oldBlks; b < newBlks; b++ {
-		newB, ok := blockA.Alloc()
-		if !ok {
-			return false
-		}
-		ino.Direct[b] = newB
+	// compared in bytes, since rounding newLen up to blocks can overflow
+	if newLen > MaxFileBlocks*disk.BlockSize {
+		return ErrFBig
 	}
-	// TODO: it's brittle (and incorrect for concurrent allocation) that we've
-	//   modified the allocator only in the transaction; reading your own writes
-	//   would make this easier to implement, but I'm not sure it makes the
-	//   abstraction and invariants easier.
-	fs.flushBalloc(op, blockA)
 	ino.NBytes = newLen
 	// TODO: leaves the inode dirty, caller must flush
 	//
 	// we should be able to flush it if we knew its inode number, potentially
 	// relying on absorption within the transaction
-	return true
+	return nil
+}
+
+// freeChunkBlocks is how many blocks a transaction frees when a large file
+// is truncated or removed a piece at a time; each could be in a different
+// bitmap block, which leaves room in MaxTxnBlocks for those and for the
+// other blocks the operation writes
+const freeChunkBlocks = MaxTxnBlocks / 2
+
+// shrinkChunk frees up to freeChunkBlocks of i's blocks past size, from the
+// end of the file, and shrinks i to just before the first one it frees
+//
+// returns true once no more than freeChunkBlocks blocks of the file are past
+// size, so that the operation truncating or removing it can free the rest
+func (fs Fs) shrinkChunk(txn *txn, i Inum, ino *inode, size uint64) bool {
+	keep := divUp(size, disk.BlockSize)
+	if divUp(ino.NBytes, disk.BlockSize) <= keep+freeChunkBlocks {
+		return true
+	}
+	cut := fs.freeInodeTail(txn, fs.blockAlloc(txn), ino, keep, freeChunkBlocks)
+	ino.NBytes = cut * disk.BlockSize
+	fs.flushInode(txn, i, ino)
+	return false
+}
+
+// shrink truncates the file i toward size a chunk per transaction, until
+// the rest is small enough to free in the transaction that finishes the
+// truncation
+//
+// each transaction leaves i a consistent (shorter) file; only the finishing
+// operation updates its timestamps
+func (fs Fs) shrink(i Inum, size uint64, guard *Time) error {
+	for {
+		done := true
+		err := fs.atomically(func(txn *txn) error {
+			done = true
+			if err := txn.lock(i); err != nil {
+				return err
+			}
+			ino := fs.getInode(txn, i)
+			if ino.Kind != INODE_KIND_FILE || ino.NBytes <= size {
+				return nil
+			}
+			if guard != nil && *guard != ino.Ctime {
+				return ErrNotSync
+			}
+			done = fs.shrinkChunk(txn, i, ino, size)
+			return nil
+		})
+		if err != nil || done {
+			return err
+		}
+	}
 }
 
-func (fs Fs) shrinkInode(op *awol.Op, ino *inode, newLen uint64) {
+// PrepareRemove frees the blocks of the file name in dirI ahead of removing
+// it, if no other links to the file remain, so that the removal fits in one
+// transaction however large the file is
+//
+// Remove calls this itself, but a Txn that removes a file should be preceded
+// by it. The blocks are freed over several transactions, so a crash can
+// leave the file truncated but not removed.
+func (fs Fs) PrepareRemove(dirI Inum, name string) error {
+	for {
+		done := true
+		err := fs.atomically(func(txn *txn) error {
+			done = true
+			if err := txn.lock(dirI); err != nil {
+				return err
+			}
+			dir := fs.getInode(txn, dirI)
+			if dir.Kind != INODE_KIND_DIR || name == "." || name == ".." {
+				return nil
+			}
+			i := fs.lookupDir(txn, dir, name)
+			if i == 0 {
+				return nil
+			}
+			if err := txn.lock(i); err != nil {
+				return err
+			}
+			ino := fs.getInode(txn, i)
+			if ino.Kind != INODE_KIND_FILE || ino.Nlink != 1 {
+				return nil
+			}
+			done = fs.shrinkChunk(txn, i, ino, 0)
+			return nil
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (fs Fs) shrinkInode(txn *txn, ino *inode, newLen uint64) {
 	if !(newLen <= ino.NBytes) {
 		panic("shrinkInode requires a smaller length")
 	}
-	oldBlks := divUp(ino.NBytes, disk.BlockSize)
 	newBlks := divUp(newLen, disk.BlockSize)
-	blockA := fs.readBalloc()
-	// newBlks <= oldBlks
-	for b := newBlks; b <= oldBlks; b++ {
-		oldB := ino.btoa(b)
-		blockA.Free(oldB)
-	}
-	// TODO: same problem as in growInode of flushing the allocator
-	fs.flushBalloc(op, blockA)
+	fs.freeInodeBlocks(txn, fs.blockAlloc(txn), ino, newBlks)
+	// the rest of the last block should read as zeroes if the file grows
+	// again
+	if newLen%disk.BlockSize != 0 && fs.btoa(txn, ino, newLen/disk.BlockSize) != 0 {
+		boff := newLen / disk.BlockSize
+		b := fs.inodeRead(txn, ino, boff)
+		for off := newLen % disk.BlockSize; off < disk.BlockSize; off++ {
+			b[off] = 0
+		}
+		fs.inodeWrite(txn, ino, boff, b)
+	}
 	ino.NBytes = newLen
 }
 
-func (fs Fs) lookupDir(dir *inode, name string) Inum {
+func (fs Fs) lookupDir(txn *txn, dir *inode, name string) Inum {
 	if dir.Kind != INODE_KIND_DIR {
 		panic("lookup on non-dir inode")
 	}
-	// invariant: directories always have length a multiple of BlockSize
-	blocks := dir.NBytes / disk.BlockSize
-	for b := uint64(0); b < blocks; b++ {
-		de := decodeDirEnt(fs.inodeRead(dir, b))
-		if !de.Valid {
-			continue
-		}
-		if de.Name == name {
-			return de.I
-		}
+	if dir.Flags&INODE_FLAG_INDEXED != 0 {
+		return fs.dxLookupName(txn, dir, name)
 	}
-	return 0
-}
-
-func (fs Fs) findFreeDirEnt(op *awol.Op, dir *inode) (uint64, bool) {
 	// invariant: directories always have length a multiple of BlockSize
 	blocks := dir.NBytes / disk.BlockSize
 	for b := uint64(0); b < blocks; b++ {
-		de := decodeDirEnt(fs.inodeRead(dir, b))
-		if !de.Valid {
-			return b, true
+		for _, de := range decodeDirBlock(fs.inodeRead(txn, dir, b)) {
+			if de.I != 0 && de.Name == name {
+				return de.I
+			}
 		}
 	}
-	// nothing free, allocate a new one
-	ok := fs.growInode(op, dir, dir.NBytes+disk.BlockSize)
-	if !ok {
-		return 0, false
-	}
-	// return the newly-allocated index
-	return blocks, true
+	return 0
 }
 
 // createLink creates a pointer name to i in the directory dir
 //
-// returns false if this fails (eg, due to allocation failure)
-func (fs Fs) createLink(op *awol.Op, dir *inode, name string, i Inum) bool {
+// returns an error if this fails (eg, due to allocation failure)
+func (fs Fs) createLink(txn *txn, dir *inode, name string, i Inum) error {
 	if dir.Kind != INODE_KIND_DIR {
 		panic("create on non-dir inode")
 	}
 	fs.checkInode(i)
-	b, ok := fs.findFreeDirEnt(op, dir)
-	if !ok {
-		fmt.Fprintln(os.Stderr, "createLink: no more space")
-		return false
-	}
-	fs.inodeWrite(op, dir, b, encodeDirEnt(&DirEnt{
-		Valid: true,
-		Name:  name,
-		I:     i,
-	}))
-	return true
+	if dir.Flags&INODE_FLAG_INDEXED != 0 {
+		return fs.dxAdd(txn, dir, name, i)
+	}
+	blocks := dir.NBytes / disk.BlockSize
+	for b := uint64(0); b < blocks; b++ {
+		block := fs.inodeRead(txn, dir, b)
+		if addDirEnt(block, name, i) {
+			fs.inodeWrite(txn, dir, b, block)
+			return nil
+		}
+	}
+	// no room: small directories are kept linear, but a directory
+	// outgrowing its first block is converted to an index
+	if blocks == 1 {
+		if err := fs.dxConvert(txn, dir); err != nil {
+			return err
+		}
+		return fs.dxAdd(txn, dir, name, i)
+	}
+	b, err := fs.appendDirBlock(txn, dir)
+	if err != nil {
+		return err
+	}
+	block := fs.inodeRead(txn, dir, b)
+	if !addDirEnt(block, name, i) {
+		panic("entry should fit in an empty block")
+	}
+	fs.inodeWrite(txn, dir, b, block)
+	return nil
 }
 
 // removeLink removes the link from name in dir
 //
 // returns true if a link was removed, false if name was not found
-func (fs Fs) removeLink(op *awol.Op, dir *inode, name string) bool {
+func (fs Fs) removeLink(txn *txn, dir *inode, name string) bool {
 	if dir.Kind != INODE_KIND_DIR {
 		panic("remove on non-dir inode")
 	}
+	if dir.Flags&INODE_FLAG_INDEXED != 0 {
+		return fs.dxRemove(txn, dir, name)
+	}
 	blocks := dir.NBytes / disk.BlockSize
 	for b := uint64(0); b < blocks; b++ {
-		de := decodeDirEnt(fs.inodeRead(dir, b))
-		if !de.Valid {
-			continue
-		}
-		if de.Name == name {
-			fs.inodeWrite(op, dir, b, encodeDirEnt(&DirEnt{
-				Valid: false,
-				Name:  "",
-				I:     0,
-			}))
+		block := fs.inodeRead(txn, dir, b)
+		if removeDirEnt(block, name) {
+			fs.inodeWrite(txn, dir, b, block)
 			return true
 		}
 	}
 	return false
 }
 
-func (fs Fs) isDirEmpty(dir *inode) bool {
+func (fs Fs) isDirEmpty(txn *txn, dir *inode) bool {
 	if dir.Kind != INODE_KIND_DIR {
 		panic("remove on non-dir inode")
 	}
 	blocks := dir.NBytes / disk.BlockSize
 	for b := uint64(0); b < blocks; b++ {
-		de := decodeDirEnt(fs.inodeRead(dir, b))
-		if de.Valid {
-			return false
+		for _, de := range decodeDirBlock(fs.inodeRead(txn, dir, b)) {
+			if de.I != 0 {
+				return false
+			}
 		}
 	}
 	return true
 }
 
-// readDirEntries reads all of the entries in dir
+// DirEntry is an entry in a directory, as returned by Readdir
+type DirEntry struct {
+	Name string
+	I    Inum
+	// Cookie can be passed to Readdir to resume listing after this entry; it
+	// is never 1 or 2, which NFS uses for "." and ".."
+	Cookie uint64
+}
+
+// DirPage is part of a directory listing
+type DirPage struct {
+	Entries []DirEntry
+	// Verifier changes whenever entries are added or removed, invalidating
+	// old cookies; other changes to the directory, such as to its mode, keep
+	// it the same
+	Verifier uint64
+	// Eof is true if there are no entries after this page
+	Eof bool
+}
+
+// readdirEntrySize is how much of Readdir's maxBytes an entry uses up
 //
-// NFS's readdir operation has a more sophisticated cookie/cookie verifier
-// mechanism for paging and reporting iterator invalidation.
-func (fs Fs) readDirEntries(dir *inode) []string {
-	names := make([]string, 0)
-	blocks := dir.NBytes / disk.BlockSize
-	for b := uint64(0); b < blocks; b++ {
-		de := decodeDirEnt(fs.inodeRead(dir, b))
-		if !de.Valid {
-			continue
-		}
-		names = append(names, de.Name)
+// this is the size of the entry in an NFS READDIR reply: 24 bytes plus the
+// name, padded to a multiple of 4
+func readdirEntrySize(name string) uint64 {
+	return 24 + divUp(uint64(len(name)), 4)*4
+}
+
+// DirPlusEntry is a directory entry with the handle and attributes of the
+// inode it refers to
+type DirPlusEntry struct {
+	DirEntry
+	Fh   Fh
+	Attr Attr
+}
+
+// DirPlusPage is part of a directory listing from ReaddirPlus
+type DirPlusPage struct {
+	Entries  []DirPlusEntry
+	Verifier uint64
+	Eof      bool
+}
+
+// readdirPlusEntrySize is like readdirEntrySize, for an NFS READDIRPLUS
+// reply: entries additionally have a post_op_attr and post_op_fh3
+func readdirPlusEntrySize(name string) uint64 {
+	return readdirEntrySize(name) + (4 + 84) + (4 + 4 + FhSize)
+}
+
+// checkName checks that name can be used for a new directory entry
+func checkName(name string) error {
+	if len(name) > MaxNameLen {
+		return ErrNameTooLong
+	}
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\x00") {
+		return ErrInval
+	}
+	return nil
+}
+
+// checkDir returns an error if ino is not a directory
+func checkDir(ino *inode) error {
+	switch ino.Kind {
+	case INODE_KIND_DIR:
+		return nil
+	case INODE_KIND_FREE:
+		return ErrStale
+	}
+	return ErrNotDir
+}
+
+// checkFile returns an error if ino is not a regular file
+func checkFile(ino *inode) error {
+	switch ino.Kind {
+	case INODE_KIND_FILE:
+		return nil
+	case INODE_KIND_DIR:
+		return ErrIsDir
+	case INODE_KIND_FREE:
+		return ErrStale
 	}
-	return names
+	return ErrInval
 }
 
 // file-system API
 
+// atomically runs op as a transaction of its own
+func (fs Fs) atomically(op func(txn *txn) error) error {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.do(op)
+}
+
 func (fs Fs) RootInode() Inum {
 	return fs.sb.rootInode
 }
 
-func (fs Fs) Lookup(i Inum, name string) Inum {
-	dir := fs.getInode(i)
-	return fs.lookupDir(dir, name)
+// FsId identifies this file system; it is chosen when the file system is
+// created and is part of every handle
+func (fs Fs) FsId() uint64 {
+	return fs.sb.FsId
 }
 
-func (fs Fs) GetAttr(i Inum) (Attr, bool) {
-	ino := fs.getInode(i)
+func (fs Fs) Lookup(i Inum, name string) (Inum, error) {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Lookup(i, name)
+}
+
+func (fs Fs) lookup(txn *txn, i Inum, name string) (Inum, error) {
+	if err := txn.lock(i); err != nil {
+		return 0, err
+	}
+	dir := fs.getInode(txn, i)
+	if err := checkDir(dir); err != nil {
+		return 0, err
+	}
+	if name == "." {
+		return i, nil
+	}
+	if name == ".." {
+		return dir.Parent, nil
+	}
+	if len(name) > MaxNameLen {
+		return 0, ErrNameTooLong
+	}
+	child := fs.lookupDir(txn, dir, name)
+	if child == 0 {
+		return 0, ErrNoEnt
+	}
+	return child, nil
+}
+
+func (fs Fs) inodeAttr(i Inum, ino *inode) Attr {
+	return Attr{
+		IsDir:     ino.Kind == INODE_KIND_DIR,
+		IsSymlink: ino.Kind == INODE_KIND_SYMLINK,
+		Mode:      uint32(ino.Mode),
+		Uid:       uint32(ino.Uid),
+		Gid:       uint32(ino.Gid),
+		Size:      ino.NBytes,
+		Nlink:     ino.Nlink,
+		Fsid:      fs.FsId(),
+		Fileid:    i,
+		Atime:     ino.Atime,
+		Mtime:     ino.Mtime,
+		Ctime:     ino.Ctime,
+	}
+}
+
+func (fs Fs) GetAttr(i Inum) (Attr, error) {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.GetAttr(i)
+}
+
+func (fs Fs) getAttr(txn *txn, i Inum) (Attr, error) {
+	if err := txn.lock(i); err != nil {
+		return Attr{}, err
+	}
+	ino := fs.getInode(txn, i)
 	if ino.Kind == INODE_KIND_FREE {
-		return Attr{}, false
+		return Attr{}, ErrStale
 	}
-	return Attr{IsDir: ino.Kind == INODE_KIND_DIR}, true
+	return fs.inodeAttr(i, ino), nil
 }
 
-func (fs Fs) Create(dirI Inum, name string, unchecked bool) (Inum, bool) {
-	op := fs.log.Begin()
-	dir := fs.getInode(dirI)
-	if dir.Kind != INODE_KIND_DIR {
-		fmt.Fprintf(os.Stderr, "Create: %d is not a dir\n", dirI)
-		return 0, false
+// SetAttr changes the attributes of i as described by attrs
+//
+// If guard is non-nil, the change is only made if i's ctime matches it, and
+// otherwise SetAttr returns ErrNotSync. Changing the size truncates or
+// zero-extends the file.
+//
+// Truncating a large file frees its blocks over several transactions, so a
+// crash can leave it only partly truncated.
+func (fs Fs) SetAttr(i Inum, attrs SetAttrs, guard *Time) error {
+	if attrs.Size != nil {
+		if err := fs.shrink(i, *attrs.Size, guard); err != nil {
+			return err
+		}
 	}
-	existingI := fs.lookupDir(dir, name)
-	if existingI != 0 {
-		if unchecked {
-			ino := fs.getInode(existingI)
-			if ino.Kind == INODE_KIND_DIR {
-				fmt.Fprintln(os.Stderr, "dir not empty")
-				return 0, false
-			}
-			fs.removeLink(op, dir, name)
+	t := fs.Begin()
+	defer t.Commit()
+	return t.SetAttr(i, attrs, guard)
+}
+
+func (fs Fs) setAttr(txn *txn, i Inum, attrs SetAttrs, guard *Time) error {
+	if err := txn.lock(i); err != nil {
+		return err
+	}
+	ino := fs.getInode(txn, i)
+	if ino.Kind == INODE_KIND_FREE {
+		return ErrStale
+	}
+	if guard != nil && *guard != ino.Ctime {
+		return ErrNotSync
+	}
+	t := now()
+	if attrs.Size != nil && *attrs.Size != ino.NBytes {
+		if err := checkFile(ino); err != nil {
+			return err
+		}
+		if *attrs.Size < ino.NBytes {
+			fs.shrinkInode(txn, ino, *attrs.Size)
 		} else {
+			if err := fs.growInode(ino, *attrs.Size); err != nil {
+				return err
+			}
+		}
+		ino.Mtime = t
+	}
+	if attrs.Mode != nil {
+		ino.Mode = uint64(*attrs.Mode & 07777)
+	}
+	if attrs.Uid != nil {
+		ino.Uid = uint64(*attrs.Uid)
+	}
+	if attrs.Gid != nil {
+		ino.Gid = uint64(*attrs.Gid)
+	}
+	if attrs.AtimeNow {
+		ino.Atime = t
+	} else if attrs.Atime != nil {
+		ino.Atime = *attrs.Atime
+	}
+	if attrs.MtimeNow {
+		ino.Mtime = t
+	} else if attrs.Mtime != nil {
+		ino.Mtime = *attrs.Mtime
+	}
+	ino.Ctime = t
+	fs.flushInode(txn, i, ino)
+	return nil
+}
+
+func (fs Fs) Create(dirI Inum, name string, unchecked bool) (Inum, error) {
+	var i Inum
+	op := func(txn *txn) error {
+		var err error
+		i, err = fs.create(txn, dirI, name, unchecked)
+		return err
+	}
+	err := fs.atomically(op)
+	if err == ErrTxnTooBig && unchecked {
+		// the file being replaced is too large to free along with the
+		// create, so free its blocks first
+		if err := fs.PrepareRemove(dirI, name); err != nil {
+			return 0, err
+		}
+		err = fs.atomically(op)
+	}
+	return i, err
+}
+
+func (fs Fs) create(txn *txn, dirI Inum, name string, unchecked bool) (Inum, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	if err := txn.lock(dirI); err != nil {
+		return 0, err
+	}
+	t := now()
+	dir := fs.getInode(txn, dirI)
+	if err := checkDir(dir); err != nil {
+		return 0, err
+	}
+	existingI := fs.lookupDir(txn, dir, name)
+	if existingI != 0 {
+		if !unchecked {
 			// checked, fail early
-			return 0, false
+			return 0, ErrExist
+		}
+		if err := txn.lock(existingI); err != nil {
+			return 0, err
+		}
+		ino := fs.getInode(txn, existingI)
+		if ino.Kind == INODE_KIND_DIR {
+			return 0, ErrIsDir
 		}
+		fs.removeLink(txn, dir, name)
+		fs.unlinkInode(txn, dir, existingI, ino, t)
 	}
-	i, ino := fs.findFreeInode()
+	i, ino := fs.findFreeInode(txn)
 	if i == 0 {
-		fmt.Fprintln(os.Stderr, "no space left")
-		return 0, false
+		return 0, ErrNoSpc
 	}
-	ok := fs.createLink(op, dir, name, i)
-	if !ok {
-		fmt.Fprintln(os.Stderr, "could not create link")
-		return 0, false
+	if err := fs.createLink(txn, dir, name, i); err != nil {
+		return 0, err
 	}
-	fs.flushInode(op, dirI, dir)
-	ino.Kind = INODE_KIND_FILE
-	fs.flushInode(op, i, ino)
-	fs.log.Commit(op)
-	return i, true
+	dir.modified(t)
+	fs.flushInode(txn, dirI, dir)
+	ino.init(INODE_KIND_FILE, 0644, t)
+	ino.Nlink = 1
+	fs.flushInode(txn, i, ino)
+	return i, nil
 }
 
-func (fs Fs) Mkdir(dirI Inum, name string) (Inum, bool) {
-	op := fs.log.Begin()
-	dir := fs.getInode(dirI)
-	if dir.Kind != INODE_KIND_DIR {
-		fmt.Fprintf(os.Stderr, "Mkdir: %d is not a dir\n", dirI)
-		return 0, false
+func (fs Fs) Mkdir(dirI Inum, name string) (Inum, error) {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Mkdir(dirI, name)
+}
+
+func (fs Fs) mkdir(txn *txn, dirI Inum, name string) (Inum, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	if err := txn.lock(dirI); err != nil {
+		return 0, err
+	}
+	dir := fs.getInode(txn, dirI)
+	if err := checkDir(dir); err != nil {
+		return 0, err
 	}
-	i, ino := fs.findFreeInode()
+	if fs.lookupDir(txn, dir, name) != 0 {
+		return 0, ErrExist
+	}
+	if dir.Nlink >= MaxLinks {
+		return 0, ErrMLink
+	}
+	i, ino := fs.findFreeInode(txn)
 	if i == 0 {
-		return 0, false
+		return 0, ErrNoSpc
 	}
-	ino.Kind = INODE_KIND_DIR
-	ok := fs.createLink(op, dir, name, i)
-	if !ok {
-		return 0, false
+	t := now()
+	ino.init(INODE_KIND_DIR, 0755, t)
+	ino.Nlink = 2
+	ino.Parent = dirI
+	if err := fs.createLink(txn, dir, name, i); err != nil {
+		return 0, err
 	}
-	fs.flushInode(op, dirI, dir)
-	fs.flushInode(op, i, ino)
-	fs.log.Commit(op)
-	return i, true
+	// for the new directory's ".."
+	dir.Nlink++
+	dir.modified(t)
+	fs.flushInode(txn, dirI, dir)
+	fs.flushInode(txn, i, ino)
+	return i, nil
+}
+
+// Read reads up to length bytes from i, starting at off
+//
+// The read is cut short at the end of the file, in which case eof is true.
+func (fs Fs) Read(i Inum, off uint64, length uint64) (data []byte, eof bool, err error) {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Read(i, off, length)
 }
 
-func (fs Fs) Read(i Inum, off uint64, length uint64) ([]byte, bool) {
-	ino := fs.getInode(i)
-	if ino.Kind != INODE_KIND_FILE {
-		return nil, false
+func (fs Fs) read(txn *txn, i Inum, off uint64, length uint64) (data []byte, eof bool, err error) {
+	if err := txn.lock(i); err != nil {
+		return nil, false, err
+	}
+	ino := fs.getInode(txn, i)
+	if err := checkFile(ino); err != nil {
+		return nil, false, err
+	}
+	if off >= ino.NBytes {
+		return []byte{}, true, nil
 	}
-	if off+length > ino.NBytes {
-		return nil, false
+	if length >= ino.NBytes-off {
+		length = ino.NBytes - off
+		eof = true
 	}
 	bs := make([]byte, 0, length)
-	for boff := off / disk.BlockSize; length > 0; boff++ {
-		b := fs.inodeRead(ino, boff)
-		if off%disk.BlockSize != 0 {
-			byteOff := off % disk.BlockSize
+	boff := off / disk.BlockSize
+	// only the first block is read from the middle
+	byteOff := off % disk.BlockSize
+	for length > 0 {
+		// read a run of blocks that are contiguous on disk (or a hole) at
+		// once, up to the blocks the read still needs
+		bn, run := fs.blockRun(txn, ino, boff)
+		if need := divUp(byteOff+length, disk.BlockSize); run > need {
+			run = need
+		}
+		var blocks []disk.Block
+		if bn == 0 {
+			blocks = make([]disk.Block, run)
+			for k := range blocks {
+				blocks[k] = make(disk.Block, disk.BlockSize)
+			}
+		} else {
+			blocks = txn.ReadRange(fs.blockAddr(bn), run)
+		}
+		for _, b := range blocks {
 			b = b[byteOff:]
+			byteOff = 0
+			if length < uint64(len(b)) {
+				b = b[:length]
+			}
+			bs = append(bs, b...)
+			length -= uint64(len(b))
 		}
-		if length < uint64(len(b)) {
-			b = b[:length]
+		boff += run
+	}
+	return bs, eof, nil
+}
+
+// writeChunkBlocks is how many blocks Write covers per transaction, which
+// leaves room in MaxTxnBlocks for the bitmap and indirect blocks that
+// allocating them could also write
+const writeChunkBlocks = MaxTxnBlocks / 4
+
+// Write writes bs to i at offset off, extending the file if it ends past the
+// end of the file
+//
+// A large write is split into several transactions, so a crash can leave
+// only a prefix of it written.
+func (fs Fs) Write(i Inum, off uint64, bs []byte) error {
+	for {
+		// each chunk but the last ends on a block boundary
+		n := writeChunkBlocks*disk.BlockSize - off%disk.BlockSize
+		if n > uint64(len(bs)) {
+			n = uint64(len(bs))
+		}
+		t := fs.Begin()
+		err := t.Write(i, off, bs[:n])
+		t.Commit()
+		if err != nil {
+			return err
+		}
+		bs = bs[n:]
+		off += n
+		if len(bs) == 0 {
+			return nil
 		}
-		bs = append(bs, b...)
-		length -= uint64(len(b))
 	}
-	return bs, true
 }
 
-func (fs Fs) Write(i Inum, off uint64, bs []byte) bool {
-	op := fs.log.Begin()
-	ino := fs.getInode(i)
-	if ino.Kind != INODE_KIND_FILE {
-		return false
+func (fs Fs) write(txn *txn, i Inum, off uint64, bs []byte) error {
+	if err := txn.lock(i); err != nil {
+		return err
+	}
+	ino := fs.getInode(txn, i)
+	if err := checkFile(ino); err != nil {
+		return err
+	}
+	// an empty write changes nothing, not even the size or timestamps
+	if len(bs) == 0 {
+		return nil
 	}
-	for boff := off / disk.BlockSize; len(bs) > 0; boff++ {
-		if off%disk.BlockSize != 0 {
-			b := fs.inodeRead(ino, boff)
-			byteOff := off % disk.BlockSize
-			nBytes := disk.BlockSize - byteOff
-			if uint64(len(bs)) < nBytes {
-				nBytes = uint64(len(bs))
+	// checked before computing the end, which could overflow
+	maxSize := uint64(MaxFileBlocks * disk.BlockSize)
+	if uint64(len(bs)) > maxSize || off > maxSize-uint64(len(bs)) {
+		return ErrFBig
+	}
+	// writing past the end extends the file, leaving a hole in any gap
+	if end := off + uint64(len(bs)); end > ino.NBytes {
+		if err := fs.growInode(ino, end); err != nil {
+			return err
+		}
+	}
+	// allocating the whole write at once lays it out contiguously
+	start := off / disk.BlockSize
+	end := (off + uint64(len(bs)) + disk.BlockSize - 1) / disk.BlockSize
+	if err := fs.allocInodeRange(txn, ino, start, end-start); err != nil {
+		return err
+	}
+	for len(bs) > 0 {
+		boff := off / disk.BlockSize
+		byteOff := off % disk.BlockSize
+		nBytes := disk.BlockSize - byteOff
+		if uint64(len(bs)) < nBytes {
+			nBytes = uint64(len(bs))
+		}
+		var b disk.Block
+		if nBytes == disk.BlockSize {
+			b = disk.Block(bs[:nBytes])
+		} else {
+			// partial block, keep the rest of its contents
+			b = fs.inodeRead(txn, ino, boff)
+			copy(b[byteOff:], bs[:nBytes])
+		}
+		fs.inodeWrite(txn, ino, boff, b)
+		bs = bs[nBytes:]
+		off += nBytes
+	}
+	ino.modified(now())
+	fs.flushInode(txn, i, ino)
+	return nil
+}
+
+// seek finds the first offset at or after off that is in data (or a hole,
+// if data is false), at block granularity
+func (fs Fs) seek(txn *txn, i Inum, off uint64, data bool) (uint64, error) {
+	if err := txn.lock(i); err != nil {
+		return 0, err
+	}
+	ino := fs.getInode(txn, i)
+	if err := checkFile(ino); err != nil {
+		return 0, err
+	}
+	if off >= ino.NBytes {
+		return 0, ErrNxio
+	}
+	blocks := divUp(ino.NBytes, disk.BlockSize)
+	for boff := off / disk.BlockSize; boff < blocks; {
+		bn, run := fs.blockRun(txn, ino, boff)
+		if (bn != 0) == data {
+			if boff*disk.BlockSize < off {
+				return off, nil
 			}
-			for i := byteOff; i < nBytes; i++ {
-				b[byteOff+i] = bs[i]
+			return boff * disk.BlockSize, nil
+		}
+		boff += run
+	}
+	if data {
+		return 0, ErrNxio
+	}
+	// there is an implicit hole at the end of the file
+	return ino.NBytes, nil
+}
+
+// SeekData finds the first offset at or after off that is not in a hole,
+// like lseek with SEEK_DATA
+//
+// Returns ErrNxio if there is no more data in the file.
+func (fs Fs) SeekData(i Inum, off uint64) (uint64, error) {
+	var pos uint64
+	err := fs.atomically(func(txn *txn) error {
+		var err error
+		pos, err = fs.seek(txn, i, off, true)
+		return err
+	})
+	return pos, err
+}
+
+// SeekHole finds the first offset at or after off that is in a hole, like
+// lseek with SEEK_HOLE; the end of the file counts as a hole
+//
+// Returns ErrNxio if off is past the end of the file.
+func (fs Fs) SeekHole(i Inum, off uint64) (uint64, error) {
+	var pos uint64
+	err := fs.atomically(func(txn *txn) error {
+		var err error
+		pos, err = fs.seek(txn, i, off, false)
+		return err
+	})
+	return pos, err
+}
+
+// readDir lists dir starting after cookie, with as many entries as fit in
+// maxBytes when each entry takes up entrySize(name) bytes
+func (fs Fs) readDir(txn *txn, dir *inode, cookie uint64, verf uint64, maxBytes uint64,
+	entrySize func(name string) uint64) (DirPage, error) {
+	// unlike the ctime, the mtime only changes with the entries (or if set
+	// explicitly)
+	page := DirPage{
+		Entries:  make([]DirEntry, 0),
+		Verifier: encodeTime(dir.Mtime),
+	}
+	// cookies are the position just past an entry: its block times
+	// BlockSize plus the end of its record
+	blocks := dir.NBytes / disk.BlockSize
+	startB := cookie / disk.BlockSize
+	startOff := cookie % disk.BlockSize
+	if cookie != 0 && (verf != page.Verifier || startB > blocks) {
+		return DirPage{}, ErrBadCookie
+	}
+	size := uint64(0)
+	for b := startB; b < blocks; b++ {
+		ents := decodeDirBlock(fs.inodeRead(txn, dir, b))
+		if b == startB && startOff != 0 {
+			// skip to the record at startOff
+			for len(ents) > 0 && ents[0].Off < startOff {
+				ents = ents[1:]
 			}
-			fs.inodeWrite(op, ino, boff, b)
-			bs = bs[nBytes:]
-			off += nBytes
-		} else if uint64(len(bs)) < disk.BlockSize {
-			b := fs.inodeRead(ino, boff)
-			for i := 0; i < len(bs); i++ {
-				b[i] = bs[i]
+			if len(ents) == 0 || ents[0].Off != startOff {
+				return DirPage{}, ErrBadCookie
 			}
-			fs.inodeWrite(op, ino, boff, b)
-			bs = nil
-		} else {
-			fs.inodeWrite(op, ino, boff, disk.Block(bs[:disk.BlockSize]))
-			bs = bs[disk.BlockSize:]
-			off += disk.BlockSize
+		}
+		for _, de := range ents {
+			if de.I == 0 {
+				continue
+			}
+			entSize := entrySize(de.Name)
+			if size+entSize > maxBytes {
+				if len(page.Entries) == 0 {
+					return DirPage{}, ErrTooSmall
+				}
+				return page, nil
+			}
+			size += entSize
+			page.Entries = append(page.Entries, DirEntry{
+				Name:   de.Name,
+				I:      de.I,
+				Cookie: b*disk.BlockSize + de.Off + de.RecLen,
+			})
 		}
 	}
-	fs.flushInode(op, i, ino)
-	fs.log.Commit(op)
-	return true
+	page.Eof = true
+	return page, nil
+}
+
+// Readdir lists the entries in dir after cookie, up to maxBytes worth
+//
+// Listing starts from the beginning with a cookie of 0; otherwise cookie
+// should be from an entry returned by an earlier call, and verf should be
+// that call's Verifier. Returns ErrBadCookie if the directory has changed
+// since and ErrTooSmall if not even one entry fits in maxBytes.
+func (fs Fs) Readdir(i Inum, cookie uint64, verf uint64, maxBytes uint64) (DirPage, error) {
+	var page DirPage
+	err := fs.atomically(func(txn *txn) error {
+		if err := txn.lock(i); err != nil {
+			return err
+		}
+		dir := fs.getInode(txn, i)
+		if err := checkDir(dir); err != nil {
+			return err
+		}
+		var err error
+		page, err = fs.readDir(txn, dir, cookie, verf, maxBytes, readdirEntrySize)
+		return err
+	})
+	if err != nil {
+		return DirPage{}, err
+	}
+	return page, nil
 }
 
-func (fs Fs) Readdir(i Inum) []string {
-	dir := fs.getInode(i)
-	return fs.readDirEntries(dir)
+// ReaddirPlus is like Readdir, but also returns the handle and attributes of
+// each entry
+func (fs Fs) ReaddirPlus(i Inum, cookie uint64, verf uint64, maxBytes uint64) (DirPlusPage, error) {
+	var plus DirPlusPage
+	err := fs.atomically(func(txn *txn) error {
+		if err := txn.lock(i); err != nil {
+			return err
+		}
+		dir := fs.getInode(txn, i)
+		if err := checkDir(dir); err != nil {
+			return err
+		}
+		page, err := fs.readDir(txn, dir, cookie, verf, maxBytes, readdirPlusEntrySize)
+		if err != nil {
+			return err
+		}
+		plus = DirPlusPage{
+			Entries:  make([]DirPlusEntry, 0, len(page.Entries)),
+			Verifier: page.Verifier,
+			Eof:      page.Eof,
+		}
+		for _, e := range page.Entries {
+			if err := txn.lock(e.I); err != nil {
+				return err
+			}
+			ino := fs.getInode(txn, e.I)
+			plus.Entries = append(plus.Entries, DirPlusEntry{
+				DirEntry: e,
+				Fh:       fs.handle(e.I, ino),
+				Attr:     fs.inodeAttr(e.I, ino),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return DirPlusPage{}, err
+	}
+	return plus, nil
 }
 
-func (fs Fs) Remove(dirI Inum, name string) bool {
-	op := fs.log.Begin()
-	dir := fs.getInode(dirI)
-	i := fs.lookupDir(dir, name)
+// Remove removes the entry name from dirI, freeing the inode it refers to
+// if no other links to it remain
+//
+// A large file is freed over several transactions (see PrepareRemove).
+func (fs Fs) Remove(dirI Inum, name string) error {
+	if err := fs.PrepareRemove(dirI, name); err != nil {
+		return err
+	}
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Remove(dirI, name)
+}
+
+func (fs Fs) remove(txn *txn, dirI Inum, name string) error {
+	if name == "." || name == ".." {
+		return ErrInval
+	}
+	if err := txn.lock(dirI); err != nil {
+		return err
+	}
+	dir := fs.getInode(txn, dirI)
+	if err := checkDir(dir); err != nil {
+		return err
+	}
+	i := fs.lookupDir(txn, dir, name)
 	if i == 0 {
-		return false
+		return ErrNoEnt
 	}
-	ino := fs.getInode(i)
+	if err := txn.lock(i); err != nil {
+		return err
+	}
+	ino := fs.getInode(txn, i)
 	if ino.Kind == INODE_KIND_FREE {
 		panic("directory entries should point to valid inodes")
 	}
 	if ino.Kind == INODE_KIND_DIR {
-		if !fs.isDirEmpty(ino) {
+		if !fs.isDirEmpty(txn, ino) {
 			// cannot unlink non-empty directory
-			return false
+			return ErrNotEmpty
 		}
 	}
-	fs.flushInode(op, i, &inode{Kind: INODE_KIND_FREE})
-	ok := fs.removeLink(op, dir, name)
+	ok := fs.removeLink(txn, dir, name)
 	if !ok {
-		return false
+		panic("name was found by lookup")
+	}
+	t := now()
+	fs.unlinkInode(txn, dir, i, ino, t)
+	dir.modified(t)
+	fs.flushInode(txn, dirI, dir)
+	return nil
+}
+
+// Symlink creates a symbolic link called name in dir, pointing to target
+func (fs Fs) Symlink(dirI Inum, name string, target string) (Inum, error) {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Symlink(dirI, name, target)
+}
+
+func (fs Fs) symlink(txn *txn, dirI Inum, name string, target string) (Inum, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	if target == "" {
+		return 0, ErrInval
+	}
+	if len(target) > MaxSymlinkLen {
+		return 0, ErrNameTooLong
+	}
+	if err := txn.lock(dirI); err != nil {
+		return 0, err
+	}
+	dir := fs.getInode(txn, dirI)
+	if err := checkDir(dir); err != nil {
+		return 0, err
+	}
+	if fs.lookupDir(txn, dir, name) != 0 {
+		return 0, ErrExist
+	}
+	i, ino := fs.findFreeInode(txn)
+	if i == 0 {
+		return 0, ErrNoSpc
+	}
+	t := now()
+	ino.init(INODE_KIND_SYMLINK, 0777, t)
+	ino.Nlink = 1
+	ino.NBytes = uint64(len(target))
+	ino.Target = []byte(target)
+	if err := fs.createLink(txn, dir, name, i); err != nil {
+		return 0, err
+	}
+	dir.modified(t)
+	fs.flushInode(txn, dirI, dir)
+	fs.flushInode(txn, i, ino)
+	return i, nil
+}
+
+// Readlink returns the target of the symbolic link i
+func (fs Fs) Readlink(i Inum) (string, error) {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Readlink(i)
+}
+
+func (fs Fs) readlink(txn *txn, i Inum) (string, error) {
+	if err := txn.lock(i); err != nil {
+		return "", err
+	}
+	ino := fs.getInode(txn, i)
+	if ino.Kind == INODE_KIND_FREE {
+		return "", ErrStale
+	}
+	if ino.Kind != INODE_KIND_SYMLINK {
+		return "", ErrInval
+	}
+	return string(ino.Target), nil
+}
+
+// Link creates an entry name in dir for the existing file i
+//
+// directories cannot have more than one link
+func (fs Fs) Link(i Inum, dirI Inum, name string) error {
+	t := fs.Begin()
+	defer t.Commit()
+	return t.Link(i, dirI, name)
+}
+
+func (fs Fs) link(txn *txn, i Inum, dirI Inum, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := txn.lockInodes(i, dirI); err != nil {
+		return err
+	}
+	ino := fs.getInode(txn, i)
+	if ino.Kind == INODE_KIND_FREE {
+		return ErrStale
+	}
+	if ino.Kind == INODE_KIND_DIR {
+		return ErrIsDir
+	}
+	if ino.Nlink >= MaxLinks {
+		return ErrMLink
+	}
+	dir := fs.getInode(txn, dirI)
+	if err := checkDir(dir); err != nil {
+		return err
+	}
+	if fs.lookupDir(txn, dir, name) != 0 {
+		return ErrExist
+	}
+	if err := fs.createLink(txn, dir, name, i); err != nil {
+		return err
+	}
+	t := now()
+	ino.Nlink++
+	ino.Ctime = t
+	dir.modified(t)
+	fs.flushInode(txn, dirI, dir)
+	fs.flushInode(txn, i, ino)
+	return nil
+}
+
+// isAncestor reports whether a is dir or one of its ancestors
+//
+// reads the directories without locking them, so the caller must hold the
+// rename lock
+func (fs Fs) isAncestor(txn *txn, a Inum, dir Inum) bool {
+	for {
+		if dir == a {
+			return true
+		}
+		if dir == fs.sb.rootInode {
+			return false
+		}
+		dir = fs.getInode(txn, dir).Parent
+	}
+}
+
+// Rename moves the entry srcName in srcDir to dstName in dstDir
+//
+// If dstName exists it is replaced, as long as it is a file being replaced
+// by a file or an empty directory being replaced by a directory.
+func (fs Fs) Rename(srcDirI Inum, srcName string, dstDirI Inum, dstName string) error {
+	op := func(txn *txn) error {
+		return fs.rename(txn, srcDirI, srcName, dstDirI, dstName)
+	}
+	err := fs.atomically(op)
+	if err == ErrTxnTooBig {
+		// the file being replaced is too large to free along with the
+		// rename, so free its blocks first
+		if err := fs.PrepareRemove(dstDirI, dstName); err != nil {
+			return err
+		}
+		err = fs.atomically(op)
+	}
+	return err
+}
+
+func (fs Fs) rename(txn *txn, srcDirI Inum, srcName string, dstDirI Inum, dstName string) error {
+	if srcName == "." || srcName == ".." {
+		return ErrInval
+	}
+	if err := checkName(dstName); err != nil {
+		return err
+	}
+	if srcDirI != dstDirI {
+		// keeps directories from moving while isAncestor looks at them
+		if err := txn.lock(renameLock); err != nil {
+			return err
+		}
+	}
+	if err := txn.lockInodes(srcDirI, dstDirI); err != nil {
+		return err
+	}
+	srcDir := fs.getInode(txn, srcDirI)
+	if err := checkDir(srcDir); err != nil {
+		return err
+	}
+	dstDir := srcDir
+	if dstDirI != srcDirI {
+		dstDir = fs.getInode(txn, dstDirI)
+		if err := checkDir(dstDir); err != nil {
+			return err
+		}
+	}
+	i := fs.lookupDir(txn, srcDir, srcName)
+	if i == 0 {
+		return ErrNoEnt
+	}
+	if srcDirI == dstDirI && srcName == dstName {
+		return nil
+	}
+	if err := txn.lock(i); err != nil {
+		return err
+	}
+	ino := fs.getInode(txn, i)
+	if ino.Kind == INODE_KIND_DIR && srcDirI != dstDirI &&
+		fs.isAncestor(txn, i, dstDirI) {
+		// would disconnect the directory from the tree
+		return ErrInval
+	}
+	existingI := fs.lookupDir(txn, dstDir, dstName)
+	if existingI == i {
+		// both names are links to the same file
+		return nil
+	}
+	if ino.Kind == INODE_KIND_DIR && srcDirI != dstDirI &&
+		dstDir.Nlink >= MaxLinks {
+		return ErrMLink
+	}
+	t := now()
+	if existingI != 0 {
+		if err := txn.lock(existingI); err != nil {
+			return err
+		}
+		existing := fs.getInode(txn, existingI)
+		if ino.Kind == INODE_KIND_DIR && existing.Kind != INODE_KIND_DIR {
+			return ErrNotDir
+		}
+		if ino.Kind != INODE_KIND_DIR && existing.Kind == INODE_KIND_DIR {
+			return ErrIsDir
+		}
+		if existing.Kind == INODE_KIND_DIR && !fs.isDirEmpty(txn, existing) {
+			return ErrNotEmpty
+		}
+		fs.removeLink(txn, dstDir, dstName)
+		fs.unlinkInode(txn, dstDir, existingI, existing, t)
+	}
+	if err := fs.createLink(txn, dstDir, dstName, i); err != nil {
+		return err
+	}
+	if !fs.removeLink(txn, srcDir, srcName) {
+		panic("name was found by lookup")
+	}
+	if ino.Kind == INODE_KIND_DIR && srcDirI != dstDirI {
+		ino.Parent = dstDirI
+		srcDir.Nlink--
+		dstDir.Nlink++
+	}
+	ino.Ctime = t
+	fs.flushInode(txn, i, ino)
+	srcDir.modified(t)
+	dstDir.modified(t)
+	fs.flushInode(txn, srcDirI, srcDir)
+	fs.flushInode(txn, dstDirI, dstDir)
+	return nil
+}
+
+// FsStat describes how much of the file system is in use
+type FsStat struct {
+	TotalBytes uint64
+	FreeBytes  uint64
+	// free space that can be used, which is all of it (none is reserved)
+	AvailBytes uint64
+	TotalFiles uint64
+	FreeFiles  uint64
+}
+
+// FsStat reports the free space and inodes, as of the last committed
+// operation
+func (fs Fs) FsStat() FsStat {
+	txn := fs.begin()
+	defer txn.release()
+	totalBlocks := uint64(fs.log.Size()) - fs.sb.dataBase
+	freeBlocks := fs.blockAlloc(txn).NumFree()
+	return FsStat{
+		TotalBytes: totalBlocks * disk.BlockSize,
+		FreeBytes:  freeBlocks * disk.BlockSize,
+		AvailBytes: freeBlocks * disk.BlockSize,
+		TotalFiles: fs.sb.numInodes,
+		FreeFiles:  fs.inodeAlloc(txn).NumFree(),
+	}
+}
+
+// MaxIOSize is the largest read or write FsInfo recommends; a Write this
+// large always fits in one transaction
+const MaxIOSize = 64 * 1024
+
+// FsInfo describes the limits and features of the file system
+type FsInfo struct {
+	MaxRead   uint64
+	PrefRead  uint64
+	MaxWrite  uint64
+	PrefWrite uint64
+	// reads and writes are best aligned to this size
+	BlockSize   uint64
+	MaxFileSize uint64
+	// the precision of the times in attributes
+	TimeDelta Time
+	Links     bool
+	Symlinks  bool
+	// SetAttr can set times to any value
+	CanSetTime bool
+}
+
+// FsInfo reports the file system's limits, which never change
+func (fs Fs) FsInfo() FsInfo {
+	return FsInfo{
+		MaxRead:     MaxIOSize,
+		PrefRead:    MaxIOSize,
+		MaxWrite:    MaxIOSize,
+		PrefWrite:   MaxIOSize,
+		BlockSize:   disk.BlockSize,
+		MaxFileSize: MaxFileBlocks * disk.BlockSize,
+		TimeDelta:   Time{Sec: 0, Nsec: 1},
+		Links:       true,
+		Symlinks:    true,
+		CanSetTime:  true,
 	}
-	fs.flushInode(op, dirI, dir)
-	fs.log.Commit(op)
-	return true
 }
@@ -1,42 +1,65 @@
 package nfs
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/tchajed/go-awol"
 	"github.com/tchajed/go-awol/mem"
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/tchajed/go-nfs/balloc"
 )
 
 type FsSuite struct {
 	suite.Suite
-	fs Fs
+	features uint64
+	fs       Fs
 }
 
 func (suite *FsSuite) SetupTest() {
 	log := mem.New(10 * 1000)
-	suite.fs = NewFs(log)
+	suite.fs = NewFsWithFeatures(log, suite.features)
 	//fmt.Printf("fs: %+v\n", suite.fs.sb)
 }
 
+// readdirNames lists all the names in dir
+func (suite *FsSuite) readdirNames(dir Inum) []string {
+	names := make([]string, 0)
+	page, err := suite.fs.Readdir(dir, 0, 0, 1<<20)
+	suite.Require().NoError(err)
+	suite.Require().True(page.Eof)
+	for _, e := range page.Entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
 func (suite *FsSuite) TestGetRoot() {
 	fs := suite.fs
 	root := fs.RootInode()
-	attr, ok := fs.GetAttr(root)
-	suite.Require().True(ok)
+	attr, err := fs.GetAttr(root)
+	suite.Require().NoError(err)
 	suite.True(attr.IsDir, "root should be a directory")
 }
 
 func (suite *FsSuite) TestCreateFile() {
 	fs := suite.fs
 	root := fs.RootInode()
-	i1, ok := fs.Create(root, "foo", false)
-	suite.Require().True(ok)
+	i1, err := fs.Create(root, "foo", false)
+	suite.Require().NoError(err)
 
-	_, ok = fs.GetAttr(i1)
-	suite.Require().True(ok, "created file should exist")
+	_, err = fs.GetAttr(i1)
+	suite.Require().NoError(err, "created file should exist")
 
-	i2, ok := fs.Create(root, "bar", false)
-	suite.True(ok)
+	i2, err := fs.Create(root, "bar", false)
+	suite.NoError(err)
 	if !suite.T().Failed() {
 		suite.NotEqual(i1, i2)
 	}
@@ -45,12 +68,12 @@ func (suite *FsSuite) TestCreateFile() {
 func (suite *FsSuite) TestCreateFiles() {
 	fs := suite.fs
 	root := fs.RootInode()
-	i1, ok := fs.Create(root, "foo", false)
+	i1, err := fs.Create(root, "foo", false)
 	suite.Equal(uint64(2), i1)
-	suite.True(ok)
+	suite.NoError(err)
 
-	i2, ok := fs.Create(root, "bar", false)
-	suite.True(ok)
+	i2, err := fs.Create(root, "bar", false)
+	suite.NoError(err)
 	if !suite.T().Failed() {
 		suite.NotEqual(i1, i2)
 	}
@@ -59,10 +82,10 @@ func (suite *FsSuite) TestCreateFiles() {
 func (suite *FsSuite) TestCreateDir() {
 	fs := suite.fs
 	root := fs.RootInode()
-	i1, ok := fs.Mkdir(root, "foo")
-	suite.Require().True(ok)
-	i2, ok := fs.Create(i1, "bar", false)
-	suite.True(ok)
+	i1, err := fs.Mkdir(root, "foo")
+	suite.Require().NoError(err)
+	i2, err := fs.Create(i1, "bar", false)
+	suite.NoError(err)
 	suite.NotEqual(i1, i2)
 }
 
@@ -72,16 +95,1425 @@ func (suite *FsSuite) TestCreateDir() {
 func (suite *FsSuite) TestUncheckedCreate() {
 	fs := suite.fs
 	root := fs.RootInode()
-	_, ok := fs.Create(root, "foo", false)
-	suite.True(ok)
+	_, err := fs.Create(root, "foo", false)
+	suite.NoError(err)
 	// this is checked, should fail
-	_, ok = fs.Create(root, "foo", false)
-	suite.False(ok)
+	_, err = fs.Create(root, "foo", false)
+	suite.Equal(ErrExist, err)
 	// this is unchecked, overwrites the previous inode
-	_, ok = fs.Create(root, "foo", true)
-	suite.True(ok)
+	_, err = fs.Create(root, "foo", true)
+	suite.NoError(err)
+}
+
+func (suite *FsSuite) TestHandles() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i1, err := fs.Create(root, "foo", false)
+	suite.Require().NoError(err)
+	fh := fs.InumToHandle(i1)
+	fh2, err := DecodeFh(fh.Encode())
+	suite.Require().NoError(err)
+	suite.Equal(fh, fh2)
+	i, err := fs.HandleToInum(fh2)
+	suite.NoError(err)
+	suite.Equal(i1, i)
+
+	_, err = DecodeFh([]byte{1, 2, 3})
+	suite.Equal(ErrBadHandle, err, "handle should be too short")
+	_, err = fs.HandleToInum(Fh{FsId: fh.FsId + 1, Ino: fh.Ino, Gen: fh.Gen})
+	suite.Equal(ErrStale, err, "handle from another file system should be invalid")
+	_, err = fs.HandleToInum(Fh{FsId: fh.FsId, Ino: 1 << 40, Gen: 0})
+	suite.Equal(ErrStale, err, "handle to nonexistent inode should be invalid")
+}
+
+func (suite *FsSuite) TestStaleHandle() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i1, err := fs.Create(root, "foo", false)
+	suite.Require().NoError(err)
+	fh := fs.InumToHandle(i1)
+	suite.Require().NoError(fs.Remove(root, "foo"))
+	_, err = fs.HandleToInum(fh)
+	suite.Equal(ErrStale, err, "handle to removed file should be stale")
+
+	// reuses the inode number, but not the generation
+	i2, err := fs.Create(root, "bar", false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(i1, i2)
+	_, err = fs.HandleToInum(fh)
+	suite.Equal(ErrStale, err, "handle to removed file should be stale")
+	i, err := fs.HandleToInum(fs.InumToHandle(i2))
+	suite.NoError(err)
+	suite.Equal(i2, i)
+}
+
+func (suite *FsSuite) TestUncheckedCreateStale() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i1, _ := fs.Create(root, "foo", false)
+	fh := fs.InumToHandle(i1)
+	_, err := fs.Create(root, "foo", true)
+	suite.Require().NoError(err)
+	_, err = fs.HandleToInum(fh)
+	suite.Equal(ErrStale, err, "overwritten file's handle should be stale")
+}
+
+func (suite *FsSuite) TestErrors() {
+	fs := suite.fs
+	root := fs.RootInode()
+	file, err := fs.Create(root, "foo", false)
+	suite.Require().NoError(err)
+	dir, err := fs.Mkdir(root, "dir")
+	suite.Require().NoError(err)
+	_, err = fs.Create(dir, "bar", false)
+	suite.Require().NoError(err)
+
+	_, err = fs.Lookup(root, "baz")
+	suite.Equal(ErrNoEnt, err)
+	_, err = fs.Lookup(file, "baz")
+	suite.Equal(ErrNotDir, err)
+	_, err = fs.Create(file, "baz", false)
+	suite.Equal(ErrNotDir, err)
+	_, err = fs.Mkdir(root, "foo")
+	suite.Equal(ErrExist, err)
+	_, err = fs.Create(root, "dir", true)
+	suite.Equal(ErrIsDir, err)
+	_, err = fs.Create(root, "a/b", false)
+	suite.Equal(ErrInval, err)
+	_, err = fs.Create(root, string(make([]byte, MaxNameLen+1)), false)
+	suite.Equal(ErrNameTooLong, err)
+	_, _, err = fs.Read(dir, 0, 0)
+	suite.Equal(ErrIsDir, err)
+	_, err = fs.Readdir(file, 0, 0, 4096)
+	suite.Equal(ErrNotDir, err)
+	suite.Equal(ErrNoEnt, fs.Remove(root, "baz"))
+	suite.Equal(ErrNotEmpty, fs.Remove(root, "dir"))
+	suite.Require().NoError(fs.Remove(root, "foo"))
+	_, err = fs.GetAttr(file)
+	suite.Equal(ErrStale, err)
+	suite.Equal("no such file or directory", ErrNoEnt.Error())
+}
+
+func (suite *FsSuite) TestRename() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, err := fs.Create(root, "foo", false)
+	suite.Require().NoError(err)
+	suite.Require().NoError(fs.Rename(root, "foo", root, "bar"))
+	_, err = fs.Lookup(root, "foo")
+	suite.Equal(ErrNoEnt, err)
+	i2, err := fs.Lookup(root, "bar")
+	suite.NoError(err)
+	suite.Equal(i, i2)
+	names := suite.readdirNames(root)
+	suite.Equal([]string{"bar"}, names)
+
+	// renaming to the same name does nothing
+	suite.NoError(fs.Rename(root, "bar", root, "bar"))
+	suite.Equal(ErrNoEnt, fs.Rename(root, "foo", root, "baz"))
+}
+
+func (suite *FsSuite) TestRenameAcrossDirs() {
+	fs := suite.fs
+	root := fs.RootInode()
+	d1, _ := fs.Mkdir(root, "d1")
+	d2, _ := fs.Mkdir(root, "d2")
+	i, err := fs.Create(d1, "foo", false)
+	suite.Require().NoError(err)
+	suite.Require().NoError(fs.Rename(d1, "foo", d2, "bar"))
+	_, err = fs.Lookup(d1, "foo")
+	suite.Equal(ErrNoEnt, err)
+	i2, _ := fs.Lookup(d2, "bar")
+	suite.Equal(i, i2)
+
+	sub, _ := fs.Mkdir(d1, "sub")
+	suite.Require().NoError(fs.Rename(d1, "sub", d2, "sub"))
+	parent, err := fs.Lookup(sub, "..")
+	suite.NoError(err)
+	suite.Equal(d2, parent, "moved directory should have a new parent")
+}
+
+func (suite *FsSuite) TestRenameOverwrite() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i1, _ := fs.Create(root, "foo", false)
+	i2, _ := fs.Create(root, "bar", false)
+	fh2 := fs.InumToHandle(i2)
+	suite.Require().NoError(fs.Rename(root, "foo", root, "bar"))
+	i, _ := fs.Lookup(root, "bar")
+	suite.Equal(i1, i)
+	_, err := fs.HandleToInum(fh2)
+	suite.Equal(ErrStale, err, "replaced file should be freed")
+	names := suite.readdirNames(root)
+	suite.Equal([]string{"bar"}, names)
+
+	d1, _ := fs.Mkdir(root, "d1")
+	fs.Mkdir(root, "d2")
+	suite.Equal(ErrIsDir, fs.Rename(root, "bar", root, "d2"))
+	suite.Equal(ErrNotDir, fs.Rename(root, "d1", root, "bar"))
+	suite.Require().NoError(fs.Rename(root, "d1", root, "d2"))
+	i, _ = fs.Lookup(root, "d2")
+	suite.Equal(d1, i)
+
+	d3, _ := fs.Mkdir(root, "d3")
+	fs.Create(d3, "foo", false)
+	suite.Equal(ErrNotEmpty, fs.Rename(root, "d2", root, "d3"))
+}
+
+func (suite *FsSuite) TestRenameIntoSubtree() {
+	fs := suite.fs
+	root := fs.RootInode()
+	a, _ := fs.Mkdir(root, "a")
+	b, _ := fs.Mkdir(a, "b")
+	suite.Equal(ErrInval, fs.Rename(root, "a", b, "a"))
+	suite.Equal(ErrInval, fs.Rename(root, "a", a, "a"))
+	suite.NoError(fs.Rename(a, "b", root, "b"))
+}
+
+func (suite *FsSuite) TestLink() {
+	fs := suite.fs
+	root := fs.RootInode()
+	dir, _ := fs.Mkdir(root, "dir")
+	i, err := fs.Create(root, "foo", false)
+	suite.Require().NoError(err)
+	suite.Require().NoError(fs.Link(i, dir, "bar"))
+	i2, _ := fs.Lookup(dir, "bar")
+	suite.Equal(i, i2)
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(uint64(2), attr.Nlink)
+
+	suite.Equal(ErrExist, fs.Link(i, dir, "bar"))
+	suite.Equal(ErrIsDir, fs.Link(dir, root, "dir2"))
+
+	// the file survives removing one of its names
+	suite.Require().NoError(fs.Remove(root, "foo"))
+	fh := fs.InumToHandle(i)
+	_, err = fs.HandleToInum(fh)
+	suite.NoError(err)
+	attr, _ = fs.GetAttr(i)
+	suite.Equal(uint64(1), attr.Nlink)
+
+	suite.Require().NoError(fs.Remove(dir, "bar"))
+	_, err = fs.HandleToInum(fh)
+	suite.Equal(ErrStale, err, "file should be freed with its last link")
+}
+
+func (suite *FsSuite) TestRenameLinks() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	fs.Link(i, root, "bar")
+	// both names refer to the same file, so this does nothing
+	suite.Require().NoError(fs.Rename(root, "foo", root, "bar"))
+	names := suite.readdirNames(root)
+	suite.ElementsMatch([]string{"foo", "bar"}, names)
+
+	i2, _ := fs.Create(root, "baz", false)
+	suite.Require().NoError(fs.Rename(root, "baz", root, "foo"))
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(uint64(1), attr.Nlink, "overwritten link should be dropped")
+	i3, _ := fs.Lookup(root, "foo")
+	suite.Equal(i2, i3)
+}
+
+func (suite *FsSuite) TestDirLinkCount() {
+	fs := suite.fs
+	root := fs.RootInode()
+	nlink := func(i Inum) uint64 {
+		attr, err := fs.GetAttr(i)
+		suite.Require().NoError(err)
+		return attr.Nlink
+	}
+	suite.Equal(uint64(2), nlink(root))
+	d1, _ := fs.Mkdir(root, "d1")
+	d2, _ := fs.Mkdir(root, "d2")
+	suite.Equal(uint64(4), nlink(root))
+	suite.Equal(uint64(2), nlink(d1))
+	fs.Mkdir(d1, "sub")
+	suite.Equal(uint64(3), nlink(d1))
+	suite.Require().NoError(fs.Rename(d1, "sub", d2, "sub"))
+	suite.Equal(uint64(2), nlink(d1))
+	suite.Equal(uint64(3), nlink(d2))
+	suite.Require().NoError(fs.Remove(d2, "sub"))
+	suite.Equal(uint64(2), nlink(d2))
+}
+
+func (suite *FsSuite) TestSymlink() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, err := fs.Symlink(root, "link", "../some/target")
+	suite.Require().NoError(err)
+	target, err := fs.Readlink(i)
+	suite.NoError(err)
+	suite.Equal("../some/target", target)
+	attr, _ := fs.GetAttr(i)
+	suite.True(attr.IsSymlink)
+	suite.Equal(uint64(len(target)), attr.Size)
+
+	_, err = fs.Symlink(root, "link", "x")
+	suite.Equal(ErrExist, err)
+	_, err = fs.Readlink(root)
+	suite.Equal(ErrInval, err)
+	_, _, err = fs.Read(i, 0, 1)
+	suite.Equal(ErrInval, err)
+
+	suite.Require().NoError(fs.Remove(root, "link"))
+	_, err = fs.Readlink(i)
+	suite.Equal(ErrStale, err)
+}
+
+func (suite *FsSuite) TestSymlinkLength() {
+	fs := suite.fs
+	root := fs.RootInode()
+	long := make([]byte, MaxSymlinkLen)
+	for i := range long {
+		long[i] = 'a'
+	}
+	i, err := fs.Symlink(root, "long", string(long))
+	suite.Require().NoError(err)
+	target, _ := fs.Readlink(i)
+	suite.Equal(string(long), target)
+
+	_, err = fs.Symlink(root, "toolong", string(long)+"a")
+	suite.Equal(ErrNameTooLong, err)
+	_, err = fs.Symlink(root, "empty", "")
+	suite.Equal(ErrInval, err)
+}
+
+func (suite *FsSuite) TestAttrs() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	d, _ := fs.Mkdir(root, "dir")
+	l, _ := fs.Symlink(root, "link", "foo")
+	attr, err := fs.GetAttr(i)
+	suite.Require().NoError(err)
+	suite.Equal(uint32(0644), attr.Mode)
+	suite.Equal(i, attr.Fileid)
+	suite.Equal(fs.InumToHandle(i).FsId, attr.Fsid)
+	suite.Equal(attr.Mtime, attr.Ctime)
+	suite.Equal(attr.Mtime, attr.Atime)
+	attr, _ = fs.GetAttr(d)
+	suite.Equal(uint32(0755), attr.Mode)
+	attr, _ = fs.GetAttr(l)
+	suite.Equal(uint32(0777), attr.Mode)
+
+	// the root was modified when link was created
+	rootAttr, _ := fs.GetAttr(root)
+	suite.Equal(attr.Ctime, rootAttr.Mtime)
+}
+
+func (suite *FsSuite) TestTimes() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	before, _ := fs.GetAttr(i)
+	time.Sleep(time.Millisecond)
+
+	fs.Link(i, root, "bar")
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(before.Mtime, attr.Mtime, "link should not change mtime")
+	suite.Greater(encodeTime(attr.Ctime), encodeTime(before.Ctime))
+
+	fs.Write(i, 0, []byte("a"))
+	after, _ := fs.GetAttr(i)
+	suite.GreaterOrEqual(encodeTime(after.Mtime), encodeTime(attr.Ctime))
+	suite.Equal(after.Mtime, after.Ctime)
+	suite.Equal(before.Atime, after.Atime)
+}
+
+func (suite *FsSuite) TestSetAttr() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	mode, uid, gid := uint32(0600), uint32(1000), uint32(100)
+	mtime := Time{Sec: 1234, Nsec: 5678}
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{
+		Mode: &mode, Uid: &uid, Gid: &gid,
+		Mtime: &mtime, AtimeNow: true,
+	}, nil))
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(mode, attr.Mode)
+	suite.Equal(uid, attr.Uid)
+	suite.Equal(gid, attr.Gid)
+	suite.Equal(mtime, attr.Mtime)
+	suite.Equal(attr.Ctime, attr.Atime)
+
+	// the guard is the current ctime
+	ctime := attr.Ctime
+	mode = 0644
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{Mode: &mode}, &ctime))
+	suite.Equal(ErrNotSync, fs.SetAttr(i, SetAttrs{Mode: &mode},
+		&Time{Sec: 1}))
+
+	size := uint64(10)
+	suite.Equal(ErrIsDir, fs.SetAttr(root, SetAttrs{Size: &size}, nil))
+}
+
+func (suite *FsSuite) TestTruncate() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	setSize := func(size uint64) {
+		suite.Require().NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+		attr, _ := fs.GetAttr(i)
+		suite.Require().Equal(size, attr.Size)
+	}
+	setSize(2 * 4096)
+	data := make([]byte, 2*4096)
+	for i := range data {
+		data[i] = 1
+	}
+	suite.Require().NoError(fs.Write(i, 0, data))
+
+	setSize(100)
+	setSize(4096 + 10)
+	bs, _, err := fs.Read(i, 0, 4096+10)
+	suite.Require().NoError(err)
+	suite.Equal(data[:100], bs[:100])
+	suite.Equal(make([]byte, 4096+10-100), bs[100:],
+		"extended part should be zero")
+
+	setSize(0)
+	setSize(4096)
+	bs, _, _ = fs.Read(i, 0, 4096)
+	suite.Equal(make([]byte, 4096), bs)
+}
+
+func (suite *FsSuite) TestReaddirPages() {
+	fs := suite.fs
+	root := fs.RootInode()
+	var expected []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		fs.Create(root, name, false)
+		expected = append(expected, name)
+	}
+	fs.Remove(root, "file3")
+	expected = append(expected[:3], expected[4:]...)
+
+	var names []string
+	var cookie, verf uint64
+	for {
+		// room for three entries
+		page, err := fs.Readdir(root, cookie, verf, 3*(24+8))
+		suite.Require().NoError(err)
+		suite.Require().True(len(page.Entries) <= 3)
+		for _, e := range page.Entries {
+			names = append(names, e.Name)
+			cookie = e.Cookie
+		}
+		verf = page.Verifier
+		if page.Eof {
+			break
+		}
+	}
+	suite.Equal(expected, names)
+
+	_, err := fs.Readdir(root, 0, 0, 10)
+	suite.Equal(ErrTooSmall, err)
+	mode := uint32(0700)
+	suite.Require().NoError(fs.SetAttr(root, SetAttrs{Mode: &mode}, nil))
+	_, err = fs.Readdir(root, cookie, verf, 4096)
+	suite.NoError(err, "changing the mode should not invalidate cookies")
+	fs.Create(root, "new", false)
+	_, err = fs.Readdir(root, cookie, verf, 4096)
+	suite.Equal(ErrBadCookie, err, "modifying the directory should change its verifier")
+}
+
+func (suite *FsSuite) TestLargeDir() {
+	fs := suite.fs
+	root := fs.RootInode()
+	dir, _ := fs.Mkdir(root, "dir")
+	var expected []string
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("file%d", i)
+		_, err := fs.Create(dir, name, false)
+		suite.Require().NoError(err)
+		expected = append(expected, name)
+	}
+	attr, _ := fs.GetAttr(dir)
+	size := attr.Size
+	suite.True(size <= 8*4096, "entries should be packed")
+
+	for i := 0; i < 500; i += 2 {
+		suite.Require().NoError(fs.Remove(dir, expected[i]))
+	}
+	for i := 0; i < 500; i += 2 {
+		_, err := fs.Create(dir, expected[i], false)
+		suite.Require().NoError(err)
+	}
+	attr, _ = fs.GetAttr(dir)
+	suite.Equal(size, attr.Size, "removed entries should be reused")
+	for _, name := range expected {
+		_, err := fs.Lookup(dir, name)
+		suite.NoError(err)
+	}
+
+	var names []string
+	var cookie, verf uint64
+	for {
+		page, err := fs.Readdir(dir, cookie, verf, 1000)
+		suite.Require().NoError(err)
+		for _, e := range page.Entries {
+			names = append(names, e.Name)
+			cookie = e.Cookie
+		}
+		verf = page.Verifier
+		if page.Eof {
+			break
+		}
+	}
+	suite.ElementsMatch(expected, names)
+	_, err := fs.Readdir(dir, cookie-8, verf, 1000)
+	suite.Equal(ErrBadCookie, err, "cookie is not at an entry")
+}
+
+// dirLevels returns the number of index levels in dir (0 if it is linear)
+func (suite *FsSuite) dirLevels(dir Inum) uint64 {
+	txn := suite.fs.begin()
+	ino := suite.fs.getInode(txn, dir)
+	if ino.Flags&INODE_FLAG_INDEXED == 0 {
+		return 0
+	}
+	path, _ := suite.fs.dxLookup(txn, ino, 0)
+	return uint64(len(path))
+}
+
+func (suite *FsSuite) TestIndexedDir() {
+	fs := suite.fs
+	root := fs.RootInode()
+	dir, _ := fs.Mkdir(root, "dir")
+	file, _ := fs.Create(root, "file", false)
+	// long names fill up blocks quickly, so that the index needs two levels
+	prefix := strings.Repeat("x", 1000)
+	name := func(i int) string { return fmt.Sprintf("%s%d", prefix, i) }
+
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(fs.Link(file, dir, name(i)))
+	}
+	suite.Equal(uint64(0), suite.dirLevels(dir), "small directory should be linear")
+	const n = 800
+	for i := 3; i < n; i++ {
+		suite.Require().NoError(fs.Link(file, dir, name(i)))
+	}
+	suite.Equal(uint64(2), suite.dirLevels(dir))
+
+	for i := 0; i < n; i++ {
+		i2, err := fs.Lookup(dir, name(i))
+		suite.Require().NoError(err)
+		suite.Equal(file, i2)
+	}
+	_, err := fs.Lookup(dir, name(n))
+	suite.Equal(ErrNoEnt, err)
+	suite.Equal(ErrExist, fs.Link(file, dir, name(0)))
+
+	var names []string
+	var cookie, verf uint64
+	for {
+		page, err := fs.Readdir(dir, cookie, verf, 1<<20)
+		suite.Require().NoError(err)
+		for _, e := range page.Entries {
+			names = append(names, e.Name)
+			cookie = e.Cookie
+		}
+		verf = page.Verifier
+		if page.Eof {
+			break
+		}
+	}
+	suite.Len(names, n)
+
+	for i := 0; i < n; i++ {
+		suite.Require().NoError(fs.Remove(dir, name(i)))
+	}
+	suite.Empty(suite.readdirNames(dir))
+	suite.NoError(fs.Remove(root, "dir"), "directory should be empty")
+}
+
+func (suite *FsSuite) TestReaddirPlus() {
+	fs := suite.fs
+	root := fs.RootInode()
+	f, _ := fs.Create(root, "foo", false)
+	d, _ := fs.Mkdir(root, "dir")
+	page, err := fs.ReaddirPlus(root, 0, 0, 4096)
+	suite.Require().NoError(err)
+	suite.True(page.Eof)
+	suite.Require().Len(page.Entries, 2)
+	for _, e := range page.Entries {
+		attr, _ := fs.GetAttr(e.I)
+		suite.Equal(attr, e.Attr)
+		suite.Equal(fs.InumToHandle(e.I), e.Fh)
+	}
+	suite.Equal(f, page.Entries[0].I)
+	suite.Equal(d, page.Entries[1].I)
+	suite.True(page.Entries[1].Attr.IsDir)
+
+	page, err = fs.ReaddirPlus(root, 0, 0, readdirPlusEntrySize("foo"))
+	suite.Require().NoError(err)
+	suite.Len(page.Entries, 1)
+	suite.False(page.Eof)
+}
+
+func (suite *FsSuite) TestTxn() {
+	fs := suite.fs
+	root := fs.RootInode()
+	t := fs.Begin()
+	dir, err := t.Mkdir(root, "dir")
+	suite.Require().NoError(err)
+	i, err := t.Create(dir, "file", false)
+	suite.Require().NoError(err)
+	suite.Require().NoError(t.Write(i, 0, []byte("hello")))
+	suite.Require().NoError(t.Rename(dir, "file", dir, "file2"))
+
+	// operations in the transaction see each other
+	i2, err := t.Lookup(dir, "file2")
+	suite.NoError(err)
+	suite.Equal(i, i2)
+	bs, _, _ := t.Read(i, 0, 5)
+	suite.Equal([]byte("hello"), bs)
+
+	// a concurrent operation waits for the transaction to finish
+	done := make(chan Inum)
+	go func() {
+		dir, _ := fs.Lookup(root, "dir")
+		done <- dir
+	}()
+	t.Commit()
+	suite.Equal(dir, <-done)
+
+	dir2, err := fs.Lookup(root, "dir")
+	suite.NoError(err)
+	suite.Equal(dir, dir2)
+	suite.Equal([]string{"file2"}, suite.readdirNames(dir))
+	bs, _, _ = fs.Read(i, 0, 5)
+	suite.Equal([]byte("hello"), bs)
+}
+
+func (suite *FsSuite) TestTxnIsolatesAttrs() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	l, _ := fs.Symlink(root, "l", "foo")
+	t := fs.Begin()
+	suite.Require().NoError(t.Write(i, 0, []byte("hello")))
+	suite.Require().NoError(t.Remove(root, "l"))
+	attr, err := t.GetAttr(i)
+	suite.NoError(err)
+	suite.Equal(uint64(5), attr.Size)
+
+	// concurrent reads of the inodes wait for the transaction to finish
+	sizes := make(chan uint64)
+	go func() {
+		attr, _ := fs.GetAttr(i)
+		sizes <- attr.Size
+	}()
+	linkErrs := make(chan error)
+	go func() {
+		_, err := fs.Readlink(l)
+		linkErrs <- err
+	}()
+	t.Commit()
+	suite.Equal(uint64(5), <-sizes)
+	suite.Equal(ErrStale, <-linkErrs)
+}
+
+func (suite *FsSuite) TestTxnAbort() {
+	fs := suite.fs
+	root := fs.RootInode()
+	free := suite.numFreeInodes()
+	t := fs.Begin()
+	dir, _ := t.Mkdir(root, "dir")
+	t.Create(dir, "file", false)
+	t.Abort()
+	_, err := fs.Lookup(root, "dir")
+	suite.Equal(ErrNoEnt, err)
+	suite.Equal(free, suite.numFreeInodes())
+	suite.Panics(func() { t.Commit() }, "transaction is already finished")
+}
+
+func (suite *FsSuite) TestTxnFailedOp() {
+	fs := suite.fs
+	root := fs.RootInode()
+	t := fs.Begin()
+	i, _ := t.Create(root, "a", false)
+	_, err := t.Create(root, "a", false)
+	suite.Equal(ErrExist, err)
+	// the failed operation allocated nothing, so the next create gets the
+	// next inode
+	i2, err := t.Create(root, "b", false)
+	suite.NoError(err)
+	suite.Equal(i+1, i2)
+	t.Commit()
+	suite.ElementsMatch([]string{"a", "b"}, suite.readdirNames(root))
+}
+
+func (suite *FsSuite) TestTxnTooLarge() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	t := fs.Begin()
+	data := make([]byte, 16*4096)
+	var err error
+	off := uint64(0)
+	for ; err == nil; off += uint64(len(data)) {
+		err = t.Write(i, off, data)
+	}
+	suite.Equal(ErrTxnTooBig, err)
+	t.Commit()
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(off-uint64(len(data)), attr.Size,
+		"earlier writes in the batch should commit")
+}
+
+func (suite *FsSuite) TestLargeWrite() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	var data []byte
+	for boff := uint64(0); boff < 2*MaxTxnBlocks; boff++ {
+		data = append(data, testBlock(boff)...)
+	}
+	// unaligned, so the chunks are too
+	off := uint64(100)
+	suite.Require().NoError(fs.Write(i, off, data),
+		"Write should split up writes too large for one transaction")
+	bs, eof, err := fs.Read(i, off, uint64(len(data)))
+	suite.NoError(err)
+	suite.True(eof)
+	suite.Equal(data, bs)
+}
+
+// commitLog is a Log that counts the transactions it commits
+type commitLog struct {
+	*mem.Log
+	commits int
+}
+
+func (l *commitLog) Commit(op *awol.Op) {
+	l.commits++
+	l.Log.Commit(op)
+}
+
+func (suite *FsSuite) TestLargeRemove() {
+	log := &commitLog{Log: mem.New(10 * 1000)}
+	suite.fs = NewFsWithFeatures(log, suite.features)
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	free := suite.numFreeBlocks()
+	const n = 3 * freeChunkBlocks
+	suite.writeBlocks(i, 0, n)
+	// far enough to need a triple-indirect block
+	suite.Require().NoError(fs.Write(i, MaxFileBlocks*4096-4096, testBlock(0)))
+
+	log.commits = 0
+	suite.Require().NoError(fs.Remove(root, "foo"),
+		"Remove should free a large file over several transactions")
+	suite.GreaterOrEqual(log.commits, n/freeChunkBlocks)
+	_, err := fs.GetAttr(i)
+	suite.Equal(ErrStale, err)
+	suite.Equal(free, suite.numFreeBlocks())
+}
+
+func (suite *FsSuite) TestLargeTruncate() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i1, _ := fs.Create(root, "foo", false)
+	i2, _ := fs.Create(root, "bar", false)
+	free := suite.numFreeBlocks()
+	// interleaved, so the blocks freed are not one run
+	const n = 3 * freeChunkBlocks
+	for boff := uint64(0); boff < n; boff += 10 {
+		suite.writeBlocks(i1, boff, boff+10)
+		suite.writeBlocks(i2, boff, boff+10)
+	}
+
+	size := uint64(100*4096 + 10)
+	suite.Require().NoError(fs.SetAttr(i1, SetAttrs{Size: &size}, nil))
+	attr, _ := fs.GetAttr(i1)
+	suite.Equal(size, attr.Size)
+	bs, _, _ := fs.Read(i1, 99*4096, 4096+10)
+	suite.Equal(append(testBlock(99), testBlock(100)[:10]...), bs)
+
+	// the truncated part of the last block reads as zeroes
+	size = 101 * 4096
+	suite.Require().NoError(fs.SetAttr(i1, SetAttrs{Size: &size}, nil))
+	bs, _, _ = fs.Read(i1, 100*4096+10, 4096-10)
+	suite.Equal(make([]byte, 4096-10), bs)
+
+	for boff := uint64(0); boff < n; boff++ {
+		bs, _, _ := fs.Read(i2, boff*4096, 4096)
+		suite.Require().Equal(testBlock(boff), bs, "block %d", boff)
+	}
+	size = 0
+	suite.Require().NoError(fs.SetAttr(i1, SetAttrs{Size: &size}, nil))
+	suite.Require().NoError(fs.SetAttr(i2, SetAttrs{Size: &size}, nil))
+	suite.Equal(free, suite.numFreeBlocks())
+}
+
+// waitLocked waits until some other operation holds lock k
+func (suite *FsSuite) waitLocked(k uint64) {
+	for suite.fs.locks.TryAcquire(k) {
+		suite.fs.locks.Release(k)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (suite *FsSuite) TestTxnLockConflict() {
+	fs := suite.fs
+	root := fs.RootInode()
+	dir, _ := fs.Mkdir(root, "dir")
+	i, _ := fs.Create(root, "foo", false)
+
+	// the batch allocates, so it holds the allocator lock
+	t := fs.Begin()
+	_, err := t.Create(root, "a", false)
+	suite.Require().NoError(err)
+
+	// these lock an inode and then wait for the allocator
+	done := make(chan error)
+	go func() {
+		done <- fs.Write(i, 0, []byte("hello"))
+	}()
+	go func() {
+		_, err := fs.Create(dir, "b", false)
+		done <- err
+	}()
+	suite.waitLocked(i)
+	suite.waitLocked(dir)
+
+	// waiting for those inodes would deadlock
+	suite.Equal(ErrJukebox, t.Write(i, 0, []byte("bye")))
+	_, err = t.Create(dir, "c", false)
+	suite.Equal(ErrJukebox, err)
+	t.Commit()
+
+	suite.NoError(<-done)
+	suite.NoError(<-done)
+	suite.Equal([]string{"b"}, suite.readdirNames(dir))
+	bs, _, _ := fs.Read(i, 0, 5)
+	suite.Equal([]byte("hello"), bs)
+}
+
+func (suite *FsSuite) TestConcurrentOps() {
+	fs := suite.fs
+	root := fs.RootInode()
+	shared, _ := fs.Mkdir(root, "shared")
+	// directory blocks are allocated lazily
+	fs.Create(root, "placeholder", false)
+	fs.Create(shared, "placeholder", false)
+	freeBlocks := suite.numFreeBlocks()
+	freeInodes := suite.numFreeInodes()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			dirName := fmt.Sprintf("dir%d", g)
+			dir, err := fs.Mkdir(root, dirName)
+			suite.NoError(err)
+			for k := 0; k < 20; k++ {
+				name := fmt.Sprintf("file%d", k)
+				sharedName := fmt.Sprintf("%d-%d", g, k)
+				i, err := fs.Create(dir, name, false)
+				suite.NoError(err)
+				suite.NoError(fs.Write(i, 0, bytes.Repeat([]byte{byte(g)}, 5000)))
+				suite.NoError(fs.Rename(dir, name, shared, sharedName))
+				suite.NoError(fs.Rename(shared, sharedName, dir, name))
+				data, _, err := fs.Read(i, 4000, 10)
+				suite.NoError(err)
+				suite.Equal(bytes.Repeat([]byte{byte(g)}, 10), data)
+				suite.NoError(fs.Remove(dir, name))
+			}
+			suite.NoError(fs.Remove(root, dirName))
+		}(g)
+	}
+	wg.Wait()
+
+	suite.Equal([]string{"placeholder"}, suite.readdirNames(shared))
+	suite.Equal(freeBlocks, suite.numFreeBlocks())
+	suite.Equal(freeInodes, suite.numFreeInodes())
+}
+
+func TestBlockPath(t *testing.T) {
+	assert := assert.New(t)
+	level, path := blockPath(3)
+	assert.Equal(0, level)
+	assert.Equal([]uint64{3}, path)
+	level, path = blockPath(NumDirect)
+	assert.Equal(1, level)
+	assert.Equal([]uint64{0}, path)
+	level, path = blockPath(NumDirect + ptrsPerBlock + ptrsPerBlock + 3)
+	assert.Equal(2, level)
+	assert.Equal([]uint64{1, 3}, path)
+	level, path = blockPath(MaxFileBlocks - 1)
+	assert.Equal(3, level)
+	assert.Equal([]uint64{ptrsPerBlock - 1, ptrsPerBlock - 1, ptrsPerBlock - 1}, path)
+}
+
+// numFreeBlocks counts the free data blocks
+func (suite *FsSuite) numFreeBlocks() int {
+	txn := suite.fs.begin()
+	defer txn.release()
+	return int(suite.fs.blockAlloc(txn).NumFree())
+}
+
+func (suite *FsSuite) numFreeInodes() int {
+	txn := suite.fs.begin()
+	defer txn.release()
+	return int(suite.fs.inodeAlloc(txn).NumFree())
+}
+
+func (suite *FsSuite) TestInodeAlloc() {
+	fs := suite.fs
+	root := fs.RootInode()
+	free := suite.numFreeInodes()
+	suite.Equal(int(fs.sb.numInodes)-1, free, "only the root should be in use")
+
+	i1, _ := fs.Create(root, "a", false)
+	i2, _ := fs.Mkdir(root, "b")
+	suite.NotEqual(i1, i2)
+	suite.Equal(free-2, suite.numFreeInodes())
+	suite.NoError(fs.Remove(root, "a"))
+	suite.Equal(free-1, suite.numFreeInodes())
+	i3, _ := fs.Create(root, "c", false)
+	suite.Equal(i1, i3, "freed inode should be reused")
+
+	// a failed create should not use up an inode
+	_, err := fs.Create(root, "c", false)
+	suite.Equal(ErrExist, err)
+	suite.Equal(free-2, suite.numFreeInodes())
+}
+
+func (suite *FsSuite) TestOutOfInodes() {
+	fs := suite.fs
+	root := fs.RootInode()
+	dir, _ := fs.Mkdir(root, "dir")
+	n := suite.numFreeInodes()
+	for k := 0; k < n; k++ {
+		_, err := fs.Create(dir, fmt.Sprintf("file%d", k), false)
+		suite.Require().NoError(err)
+	}
+	_, err := fs.Create(dir, "one-more", false)
+	suite.Equal(ErrNoSpc, err)
+	suite.NoError(fs.Remove(dir, "file0"))
+	_, err = fs.Create(dir, "one-more", false)
+	suite.NoError(err)
+}
+
+func (suite *FsSuite) TestIndirectBlocks() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	free := suite.numFreeBlocks()
+	numBlocks := uint64(NumDirect + ptrsPerBlock + 10)
+	suite.writeBlocks(i, 0, numBlocks)
+	// one single-indirect block, plus a double-indirect block and the first
+	// indirect block it points to
+	indirect := 3
+	if suite.fs.sb.hasExtents() {
+		indirect = 0
+	}
+	suite.Equal(free-int(numBlocks)-indirect, suite.numFreeBlocks())
+
+	block := testBlock
+	offsets := []uint64{0, NumDirect - 1, NumDirect, NumDirect + 1,
+		NumDirect + ptrsPerBlock - 1, NumDirect + ptrsPerBlock, numBlocks - 1}
+	for _, boff := range offsets {
+		bs, _, err := fs.Read(i, boff*4096, 4096)
+		suite.Require().NoError(err)
+		suite.Equal(block(boff), bs, "block %d", boff)
+	}
+
+	bs, _, err := fs.Read(i, NumDirect*4096-1, 2)
+	suite.Require().NoError(err)
+	suite.Equal(append(block(NumDirect - 1)[4095:], block(NumDirect)[0]), bs,
+		"read across blocks")
+
+	size := uint64(NumDirect+1) * 4096
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	if suite.fs.sb.hasExtents() {
+		indirect = 0
+	} else {
+		indirect = 1
+	}
+	suite.Equal(free-(NumDirect+1)-indirect, suite.numFreeBlocks())
+	bs, _, _ = fs.Read(i, NumDirect*4096, 4096)
+	suite.Equal(block(NumDirect), bs)
+
+	size = 0
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	suite.Equal(free, suite.numFreeBlocks())
+}
+
+func (suite *FsSuite) TestAppend() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	var expected []byte
+	for k := 0; k < 20; k++ {
+		chunk := bytes.Repeat([]byte{byte(k + 1)}, 1000)
+		attr, _ := fs.GetAttr(i)
+		suite.Require().NoError(fs.Write(i, attr.Size, chunk))
+		expected = append(expected, chunk...)
+	}
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(uint64(len(expected)), attr.Size)
+	bs, eof, err := fs.Read(i, 0, attr.Size)
+	suite.Require().NoError(err)
+	suite.True(eof)
+	suite.Equal(expected, bs)
+}
+
+func (suite *FsSuite) TestWritePastEnd() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	suite.Require().NoError(fs.Write(i, 3, []byte("abc")))
+	suite.Require().NoError(fs.Write(i, 3*4096-2, []byte("defg")))
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(uint64(3*4096+2), attr.Size)
+
+	bs, _, _ := fs.Read(i, 0, 6)
+	suite.Equal([]byte("\x00\x00\x00abc"), bs)
+	bs, _, _ = fs.Read(i, 6, 3*4096-8)
+	suite.Equal(make([]byte, 3*4096-8), bs, "gap should read as zeroes")
+	bs, _, _ = fs.Read(i, 3*4096-2, 4)
+	suite.Equal([]byte("defg"), bs)
+
+	// overwrite across a block boundary, in the middle of the file
+	suite.Require().NoError(fs.Write(i, 4096-1, []byte("xy")))
+	bs, _, _ = fs.Read(i, 4096-2, 4)
+	suite.Equal([]byte("\x00xy\x00"), bs)
+	attr, _ = fs.GetAttr(i)
+	suite.Equal(uint64(3*4096+2), attr.Size, "overwrite should not change size")
+}
+
+func (suite *FsSuite) TestEmptyWrite() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	suite.Require().NoError(fs.Write(i, 0, []byte("abc")))
+	before, _ := fs.GetAttr(i)
+	time.Sleep(time.Millisecond)
+
+	suite.Require().NoError(fs.Write(i, 10*4096, nil))
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(before, attr, "empty write past the end should change nothing")
+}
+
+func (suite *FsSuite) TestShortRead() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	suite.Require().NoError(fs.Write(i, 0, []byte("hello")))
+
+	bs, eof, err := fs.Read(i, 0, 3)
+	suite.NoError(err)
+	suite.False(eof)
+	suite.Equal([]byte("hel"), bs)
+	bs, eof, _ = fs.Read(i, 2, 100)
+	suite.True(eof, "read to the end should set eof")
+	suite.Equal([]byte("llo"), bs)
+	bs, eof, _ = fs.Read(i, 0, 5)
+	suite.True(eof)
+	suite.Equal([]byte("hello"), bs)
+	bs, eof, err = fs.Read(i, 10, 100)
+	suite.NoError(err)
+	suite.True(eof)
+	suite.Empty(bs)
+}
+
+// testBlock is the contents written to block boff by writeBlocks
+func testBlock(boff uint64) []byte {
+	b := make([]byte, 4096)
+	b[0] = byte(boff)
+	b[4095] = byte(boff >> 8)
+	return b
+}
+
+// writeBlocks writes blocks start up to end of i, a few at a time
+func (suite *FsSuite) writeBlocks(i Inum, start uint64, end uint64) {
+	for boff := start; boff < end; {
+		var data []byte
+		for ; boff < end && len(data) < 16*4096; boff++ {
+			data = append(data, testBlock(boff)...)
+		}
+		off := boff*4096 - uint64(len(data))
+		suite.Require().NoError(suite.fs.Write(i, off, data))
+	}
+}
+
+func (suite *FsSuite) TestRemoveFreesBlocks() {
+	fs := suite.fs
+	root := fs.RootInode()
+	// give the root directory its first block
+	fs.Create(root, "keep", false)
+	free := suite.numFreeBlocks()
+	// each round uses more than half of the disk, so leaked blocks would run
+	// out of space by the second round
+	fileBlocks := uint64(free/2 + 10)
+	for round := 0; round < 4; round++ {
+		i, _ := fs.Create(root, "file", false)
+		suite.writeBlocks(i, 0, fileBlocks)
+		dir, _ := fs.Mkdir(root, "dir")
+		for k := 0; k < 200; k++ {
+			_, err := fs.Create(dir, fmt.Sprintf("file%d", k), false)
+			suite.Require().NoError(err)
+		}
+		_, err := fs.Symlink(root, "link", "file")
+		suite.Require().NoError(err)
+		for k := 0; k < 200; k++ {
+			suite.Require().NoError(fs.Remove(dir, fmt.Sprintf("file%d", k)))
+		}
+		suite.Require().NoError(fs.Remove(root, "dir"))
+		suite.Require().NoError(fs.Remove(root, "link"))
+		suite.Require().NoError(fs.Remove(root, "file"))
+		suite.Equal(free, suite.numFreeBlocks(), "round %d", round)
+	}
+}
+
+func (suite *FsSuite) TestOverwriteFreesBlocks() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "a", false)
+	free := suite.numFreeBlocks()
+	suite.writeBlocks(i, 0, 10)
+	_, err := fs.Create(root, "a", true)
+	suite.Require().NoError(err)
+	suite.Equal(free, suite.numFreeBlocks(), "unchecked create should free old file")
+
+	i, _ = fs.Create(root, "b", false)
+	suite.writeBlocks(i, 0, 10)
+	suite.Require().NoError(fs.Rename(root, "a", root, "b"))
+	suite.Equal(free, suite.numFreeBlocks(), "rename should free replaced file")
+}
+
+func (suite *FsSuite) TestGrowLimit() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	free := suite.numFreeBlocks()
+	size := uint64(MaxFileBlocks) * 4096
+	suite.NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	suite.Equal(free, suite.numFreeBlocks(), "growing should not allocate")
+	size++
+	suite.Equal(ErrFBig, fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	suite.Equal(ErrFBig, fs.Write(i, size-1, []byte{1}))
+
+	// sizes that overflow when rounded up to blocks
+	for _, size := range []uint64{1<<64 - 1, 1<<64 - 4096} {
+		suite.Equal(ErrFBig, fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	}
+	// offsets where the end of the write overflows
+	for _, off := range []uint64{1<<64 - 1, 1<<64 - 4096} {
+		suite.Equal(ErrFBig, fs.Write(i, off, make([]byte, 4096)))
+	}
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(uint64(MaxFileBlocks)*4096, attr.Size)
+	_, _, err := fs.Read(i, 0, 10)
+	suite.NoError(err)
+}
+
+func (suite *FsSuite) TestSparseFile() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	free := suite.numFreeBlocks()
+	far := uint64(NumDirect+ptrsPerBlock*ptrsPerBlock+5) * 4096
+	suite.Require().NoError(fs.Write(i, far+10, []byte("hello")))
+	attr, _ := fs.GetAttr(i)
+	suite.Equal(far+15, attr.Size)
+	suite.True(free-suite.numFreeBlocks() <= 4,
+		"only the written block (and indirect blocks) should be allocated")
+
+	bs, _, _ := fs.Read(i, far-4096, 4096+15)
+	suite.Equal(append(make([]byte, 4096+10), "hello"...), bs)
+	suite.Require().NoError(fs.Write(i, 5*4096, testBlock(5)))
+	bs, _, _ = fs.Read(i, 4*4096, 3*4096)
+	suite.Equal(append(append(make([]byte, 4096), testBlock(5)...), make([]byte, 4096)...), bs)
+
+	// shrinking into a hole should not allocate the last block
+	size := uint64(7*4096 + 100)
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	suite.Equal(free-1, suite.numFreeBlocks())
+}
+
+func (suite *FsSuite) TestSeek() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	size := uint64(1 << 30)
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	_, err := fs.SeekData(i, 0)
+	suite.Equal(ErrNxio, err, "empty file has no data")
+	off, _ := fs.SeekHole(i, 0)
+	suite.Equal(uint64(0), off)
+
+	suite.writeBlocks(i, 3, 5)
+	far := uint64(NumDirect+3*ptrsPerBlock) * 4096
+	suite.Require().NoError(fs.Write(i, far, []byte("x")))
+
+	off, _ = fs.SeekData(i, 0)
+	suite.Equal(uint64(3*4096), off)
+	off, _ = fs.SeekData(i, 3*4096+7)
+	suite.Equal(uint64(3*4096+7), off, "offset in data should be returned as-is")
+	off, _ = fs.SeekHole(i, 3*4096)
+	suite.Equal(uint64(5*4096), off)
+	off, _ = fs.SeekData(i, 5*4096)
+	suite.Equal(far, off)
+	off, _ = fs.SeekHole(i, far)
+	suite.Equal(far+4096, off)
+	_, err = fs.SeekData(i, far+4096)
+	suite.Equal(ErrNxio, err)
+	_, err = fs.SeekHole(i, size)
+	suite.Equal(ErrNxio, err)
+
+	// the end of the file is a hole even in the middle of a block
+	size = far + 100
+	suite.Require().NoError(fs.SetAttr(i, SetAttrs{Size: &size}, nil))
+	off, _ = fs.SeekHole(i, far)
+	suite.Equal(size, off)
+}
+
+func (suite *FsSuite) TestExtents() {
+	if !suite.fs.sb.hasExtents() {
+		return
+	}
+	fs := suite.fs
+	root := fs.RootInode()
+	writeBlock := func(i Inum, boff uint64) error {
+		return fs.Write(i, boff*4096, testBlock(boff))
+	}
+	extentsOf := func(i Inum) int {
+		return len(fs.getInode(fs.begin(), i).Extents)
+	}
+	i1, _ := fs.Create(root, "foo", false)
+	suite.writeBlocks(i1, 0, 100)
+	suite.Equal(1, extentsOf(i1), "sequential allocation should use one extent")
+
+	// alternate allocating blocks to i2 and other files, so it is not
+	// contiguous and needs more extents than fit in the inode
+	i2, _ := fs.Create(root, "bar", false)
+	i3, _ := fs.Create(root, "baz", false)
+	const n = numExtents + extentsPerBlock + 10
+	for boff := uint64(0); boff < n; boff++ {
+		suite.Require().NoError(writeBlock(i2, boff))
+		if boff%2 == 0 {
+			suite.Require().NoError(writeBlock(i1, 100+boff/2))
+		} else {
+			suite.Require().NoError(writeBlock(i3, boff/2))
+		}
+	}
+	suite.Equal(n, extentsOf(i2))
+	suite.Len(fs.getInode(fs.begin(), i2).ExtentBlocks, 2)
+	for boff := uint64(0); boff < n; boff++ {
+		bs, _, _ := fs.Read(i2, boff*4096, 4096)
+		suite.Require().Equal(testBlock(boff), bs, "block %d", boff)
+	}
+
+	bs, _, err := fs.Read(i1, 99*4096, 2*4096)
+	suite.NoError(err)
+	suite.Equal(append(testBlock(99), testBlock(100)...), bs)
+
+	// blocks can be allocated out of order, and ones adjacent both in the
+	// file and on disk still merge
+	i4, _ := fs.Create(root, "sparse", false)
+	for _, boff := range []uint64{10, 0, 1, 5, 6} {
+		suite.Require().NoError(writeBlock(i4, boff))
+	}
+	suite.Equal(3, extentsOf(i4))
+	ino := fs.getInode(fs.begin(), i4)
+	for k := 1; k < len(ino.Extents); k++ {
+		suite.True(ino.Extents[k-1].Off+ino.Extents[k-1].Len <= ino.Extents[k].Off,
+			"extents should be sorted")
+	}
+	for _, boff := range []uint64{0, 1, 5, 6, 10} {
+		bs, _, _ := fs.Read(i4, boff*4096, 4096)
+		suite.Equal(testBlock(boff), bs, "block %d", boff)
+	}
+
+	// truncating frees the extent blocks along with the data
+	free := suite.numFreeBlocks()
+	size := uint64(10 * 4096)
+	suite.Require().NoError(fs.SetAttr(i2, SetAttrs{Size: &size}, nil))
+	suite.Equal(10, extentsOf(i2))
+	suite.Empty(fs.getInode(fs.begin(), i2).ExtentBlocks)
+	suite.Equal(free+n-10+2, suite.numFreeBlocks())
+}
+
+func (suite *FsSuite) TestContiguousWrite() {
+	fs := suite.fs
+	root := fs.RootInode()
+	i1, _ := fs.Create(root, "foo", false)
+	i2, _ := fs.Create(root, "bar", false)
+	i3, _ := fs.Create(root, "baz", false)
+	// interleave the blocks of i1 and i2 and then free i2's, so the free
+	// space right after each block of i1 is a single block
+	for boff := uint64(0); boff < 8; boff++ {
+		suite.Require().NoError(fs.Write(i1, boff*4096, testBlock(boff)))
+		suite.Require().NoError(fs.Write(i2, boff*4096, testBlock(boff)))
+	}
+	suite.Require().NoError(fs.Write(i3, 0, testBlock(0)))
+	suite.Require().NoError(fs.Remove(root, "bar"))
+
+	var data []byte
+	for boff := uint64(8); boff < 72; boff++ {
+		data = append(data, testBlock(boff)...)
+	}
+	suite.Require().NoError(fs.Write(i1, 8*4096, data))
+	txn := fs.begin()
+	ino := fs.getInode(txn, i1)
+	start := fs.btoa(txn, ino, 8)
+	for boff := uint64(8); boff < 72; boff++ {
+		suite.Equal(start+(boff-8), fs.btoa(txn, ino, boff),
+			"block %d should follow the previous one", boff)
+	}
+	bs, _, err := fs.Read(i1, 8*4096, uint64(len(data)))
+	suite.NoError(err)
+	suite.Equal(data, bs)
+}
+
+// rangeLog is a RangeLog that counts requests to read ranges
+type rangeLog struct {
+	*mem.Log
+	ranges int
+}
+
+func (l *rangeLog) ReadRange(a uint64, n uint64) []disk.Block {
+	l.ranges++
+	bs := make([]disk.Block, n)
+	for k := range bs {
+		bs[k] = l.Read(a + uint64(k))
+	}
+	return bs
+}
+
+func (suite *FsSuite) TestRangeReads() {
+	log := &rangeLog{Log: mem.New(10 * 1000)}
+	fs := NewFsWithFeatures(log, suite.features)
+	root := fs.RootInode()
+	i, _ := fs.Create(root, "foo", false)
+	var data []byte
+	for boff := uint64(0); boff < 32; boff++ {
+		data = append(data, testBlock(boff)...)
+	}
+	suite.Require().NoError(fs.Write(i, 0, data))
+
+	log.ranges = 0
+	bs, _, err := fs.Read(i, 10, uint64(len(data))-20)
+	suite.NoError(err)
+	suite.Equal(data[10:len(data)-10], bs)
+	suite.Equal(1, log.ranges, "contiguous blocks should be read at once")
+
+	// reads within a batch see its writes, even if they are in a range
+	t := fs.Begin()
+	suite.Require().NoError(t.Write(i, 5*4096, []byte("hello")))
+	bs, _, err = t.Read(i, 0, uint64(len(data)))
+	suite.NoError(err)
+	copy(data[5*4096:], "hello")
+	suite.Equal(data, bs)
+	t.Commit()
+}
+
+// bitmapWrites counts the blocks of a bitmap that txn writes
+func bitmapWrites(txn *txn, base uint64, numBlocks uint64) int {
+	n := 0
+	for a := range txn.bitmaps {
+		if base <= a && a < base+numBlocks {
+			n++
+		}
+	}
+	return n
+}
+
+func (suite *FsSuite) TestAllocatorWrites() {
+	log := mem.New(50 * 1000)
+	fs := NewFsWithFeatures(log, suite.features)
+	sb := fs.sb
+	suite.Require().True(sb.NumBlockBitmaps > 1)
+	root := fs.RootInode()
+
+	t := fs.Begin()
+	i, err := t.Create(root, "foo", false)
+	suite.Require().NoError(err)
+	suite.Require().NoError(t.Write(i, 0, make([]byte, 10*4096)))
+	suite.Equal(1, bitmapWrites(t.txn, sb.blockAllocBase, sb.NumBlockBitmaps),
+		"only the bitmap block allocated from should be written")
+	suite.Equal(1, bitmapWrites(t.txn, sb.inodeAllocBase, sb.NumInodeBitmaps))
+	t.Commit()
+
+	t = fs.Begin()
+	suite.Require().NoError(t.Write(i, 0, []byte("hello")))
+	suite.Equal(0, bitmapWrites(t.txn, sb.blockAllocBase, sb.NumBlockBitmaps),
+		"overwrites should not touch the bitmap")
+	free := fs.blockA.bm.NumFree()
+	suite.Require().NoError(t.Write(i, 20*4096, []byte("hello")))
+	t.Abort()
+	suite.Equal(free, fs.blockA.bm.NumFree(), "abort should undo allocations")
+
+	t = fs.Begin()
+	suite.Require().NoError(t.Remove(root, "foo"))
+	t.Abort()
+	suite.Equal(free, fs.blockA.bm.NumFree(), "abort should undo frees")
+
+	suite.Require().NoError(fs.Remove(root, "foo"))
+	// the in-memory bitmaps should match what was logged
+	for _, a := range []*allocator{fs.blockA, fs.inodeA} {
+		for k := uint64(0); k < a.bm.Size()/balloc.ItemsPerBitmap; k++ {
+			suite.Equal(log.Read(a.base+k), a.block(a.base+k))
+		}
+	}
+}
+
+func (suite *FsSuite) TestFsStat() {
+	fs := suite.fs
+	root := fs.RootInode()
+	// the root directory's first block is allocated lazily
+	fs.Create(root, "placeholder", false)
+	st := fs.FsStat()
+	suite.Equal(uint64(fs.log.Size())-fs.sb.dataBase, st.TotalBytes/4096)
+	suite.Equal(uint64(suite.numFreeBlocks())*4096, st.FreeBytes)
+	suite.Equal(st.FreeBytes, st.AvailBytes)
+	suite.Equal(fs.sb.numInodes, st.TotalFiles)
+	suite.Equal(uint64(suite.numFreeInodes()), st.FreeFiles)
+
+	i, _ := fs.Create(root, "foo", false)
+	suite.writeBlocks(i, 0, 10)
+	st2 := fs.FsStat()
+	suite.Equal(st.FreeBytes-10*4096, st2.FreeBytes)
+	suite.Equal(st.FreeFiles-1, st2.FreeFiles)
+
+	suite.Require().NoError(fs.Remove(root, "foo"))
+	suite.Equal(st, fs.FsStat())
+}
+
+func (suite *FsSuite) TestFsInfo() {
+	fs := suite.fs
+	root := fs.RootInode()
+	info := fs.FsInfo()
+	suite.Equal(uint64(MaxFileBlocks*4096), info.MaxFileSize)
+	// a write of the maximum size should fit in a transaction, even in a new
+	// file that needs indirect blocks
+	i, _ := fs.Create(root, "foo", false)
+	off := uint64(NumDirect*4096 - 4096/2)
+	suite.NoError(fs.Write(i, off, make([]byte, info.MaxWrite)))
+	data, _, err := fs.Read(i, off, info.MaxRead)
+	suite.NoError(err)
+	suite.Equal(info.MaxRead, uint64(len(data)))
+}
+
+func (suite *FsSuite) TestReopenFeatures() {
+	fs2 := OpenFs(suite.fs.log)
+	suite.Equal(suite.features, fs2.sb.Features)
 }
 
 func TestFs(t *testing.T) {
 	suite.Run(t, new(FsSuite))
 }
+
+func TestFsExtents(t *testing.T) {
+	suite.Run(t, &FsSuite{features: FeatureExtents})
+}
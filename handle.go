@@ -0,0 +1,83 @@
+package nfs
+
+import (
+	"github.com/tchajed/goose/machine"
+)
+
+// Fh is a file handle, which names an inode persistently
+//
+// Inode numbers are reused, so a handle also records the inode's generation
+// number, which changes each time the inode is freed. A handle from before
+// the inode was freed is stale and no longer refers to any file.
+type Fh struct {
+	FsId uint64
+	Ino  Inum
+	Gen  uint64
+}
+
+// FhSize is the size of an encoded file handle
+const FhSize = 3 * 8
+
+func (fh Fh) Encode() []byte {
+	b := make([]byte, FhSize)
+	machine.UInt64Put(b[0:8], fh.FsId)
+	machine.UInt64Put(b[8:16], fh.Ino)
+	machine.UInt64Put(b[16:24], fh.Gen)
+	return b
+}
+
+// DecodeFh parses an encoded file handle
+//
+// returns ErrBadHandle if b is not a well-formed handle
+func DecodeFh(b []byte) (Fh, error) {
+	if len(b) != FhSize {
+		return Fh{}, ErrBadHandle
+	}
+	return Fh{
+		FsId: machine.UInt64Get(b[0:8]),
+		Ino:  machine.UInt64Get(b[8:16]),
+		Gen:  machine.UInt64Get(b[16:24]),
+	}, nil
+}
+
+func (fs Fs) handle(i Inum, ino *inode) Fh {
+	return Fh{FsId: fs.sb.FsId, Ino: i, Gen: ino.Gen}
+}
+
+func (fs Fs) InumToHandle(i Inum) Fh {
+	var fh Fh
+	fs.atomically(func(txn *txn) error {
+		if err := txn.lock(i); err != nil {
+			return err
+		}
+		fh = fs.handle(i, fs.getInode(txn, i))
+		return nil
+	})
+	return fh
+}
+
+// HandleToInum finds the inode referred to by fh
+//
+// returns ErrStale if the handle is stale or is not from this file system
+func (fs Fs) HandleToInum(fh Fh) (Inum, error) {
+	if fh.FsId != fs.sb.FsId {
+		return 0, ErrStale
+	}
+	if fh.Ino == 0 || fh.Ino > fs.sb.numInodes {
+		return 0, ErrStale
+	}
+	err := fs.atomically(func(txn *txn) error {
+		if err := txn.lock(fh.Ino); err != nil {
+			return err
+		}
+		ino := fs.getInode(txn, fh.Ino)
+		if ino.Kind == INODE_KIND_FREE || ino.Gen != fh.Gen {
+			return ErrStale
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fh.Ino, nil
+}
@@ -0,0 +1,302 @@
+package nfs
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/tchajed/goose/machine"
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// Directories that outgrow a single block are indexed by a hash of the names
+// in them. Block 0 of an indexed directory is the root of the index, which
+// maps ranges of hashes to blocks; with more than one level, the root points
+// to interior index blocks, which in turn point to leaf blocks. Leaves are
+// ordinary directory blocks, holding every entry whose name hashes into the
+// leaf's range, so finding a name takes one block read per level plus one
+// for the leaf.
+//
+// An index block starts with a free record spanning the whole block, so a
+// linear scan of the directory (as in Readdir) sees it as empty:
+//
+// [ free record header (16 bytes) | Levels (8) | count (8) | entries ]
+//
+// where each entry is a (Hash, Block) pair, sorted by hash. An entry covers
+// the hashes from its Hash up to the next entry's; the root's first entry
+// always has Hash 0.
+
+const dxHeader = dirEntHeader + 16
+
+const dxEntrySize = 16
+
+const dxMaxEntries = (disk.BlockSize - dxHeader) / dxEntrySize
+
+// dxMaxLevels is the depth of the largest index, which has room for
+// dxMaxEntries*dxMaxEntries leaves
+const dxMaxLevels = 2
+
+func nameHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+type dxEntry struct {
+	Hash  uint64
+	Block uint64 // offset of the block within the directory
+}
+
+// dxNode is an index block
+type dxNode struct {
+	// for the root, the number of levels of index blocks (unused elsewhere)
+	Levels  uint64
+	Entries []dxEntry
+}
+
+func encodeDxNode(n *dxNode) disk.Block {
+	if uint64(len(n.Entries)) > dxMaxEntries {
+		panic("too many index entries")
+	}
+	b := newDirBlock()
+	machine.UInt64Put(b[dirEntHeader:dirEntHeader+8], n.Levels)
+	machine.UInt64Put(b[dirEntHeader+8:dxHeader], uint64(len(n.Entries)))
+	for k, e := range n.Entries {
+		off := dxHeader + uint64(k)*dxEntrySize
+		machine.UInt64Put(b[off:off+8], e.Hash)
+		machine.UInt64Put(b[off+8:off+16], e.Block)
+	}
+	return b
+}
+
+func decodeDxNode(b disk.Block) *dxNode {
+	n := &dxNode{}
+	n.Levels = machine.UInt64Get(b[dirEntHeader : dirEntHeader+8])
+	count := machine.UInt64Get(b[dirEntHeader+8 : dxHeader])
+	if count == 0 || count > dxMaxEntries {
+		panic("corrupt index block")
+	}
+	for k := uint64(0); k < count; k++ {
+		off := dxHeader + k*dxEntrySize
+		n.Entries = append(n.Entries, dxEntry{
+			Hash:  machine.UInt64Get(b[off : off+8]),
+			Block: machine.UInt64Get(b[off+8 : off+16]),
+		})
+	}
+	return n
+}
+
+// find returns the index of the entry covering h
+func (n *dxNode) find(h uint64) int {
+	k := sort.Search(len(n.Entries), func(k int) bool {
+		return n.Entries[k].Hash > h
+	})
+	if k == 0 {
+		panic("hash below index range")
+	}
+	return k - 1
+}
+
+func (n *dxNode) insert(k int, e dxEntry) {
+	n.Entries = append(n.Entries, dxEntry{})
+	copy(n.Entries[k+1:], n.Entries[k:])
+	n.Entries[k] = e
+}
+
+// dxStep is one index block on the way to a leaf
+type dxStep struct {
+	block uint64
+	node  *dxNode
+	idx   int // the entry followed
+}
+
+// dxLookup finds the leaf of an indexed directory covering hash h, along
+// with the index blocks leading to it
+func (fs Fs) dxLookup(txn *txn, dir *inode, h uint64) ([]dxStep, uint64) {
+	root := decodeDxNode(fs.inodeRead(txn, dir, 0))
+	var path []dxStep
+	b := uint64(0)
+	node := root
+	for level := uint64(0); level < root.Levels; level++ {
+		if level > 0 {
+			node = decodeDxNode(fs.inodeRead(txn, dir, b))
+		}
+		k := node.find(h)
+		path = append(path, dxStep{block: b, node: node, idx: k})
+		b = node.Entries[k].Block
+	}
+	return path, b
+}
+
+func (fs Fs) dxLookupName(txn *txn, dir *inode, name string) Inum {
+	_, leaf := fs.dxLookup(txn, dir, nameHash(name))
+	for _, de := range decodeDirBlock(fs.inodeRead(txn, dir, leaf)) {
+		if de.I != 0 && de.Name == name {
+			return de.I
+		}
+	}
+	return 0
+}
+
+func (fs Fs) dxRemove(txn *txn, dir *inode, name string) bool {
+	_, leaf := fs.dxLookup(txn, dir, nameHash(name))
+	block := fs.inodeRead(txn, dir, leaf)
+	if removeDirEnt(block, name) {
+		fs.inodeWrite(txn, dir, leaf, block)
+		return true
+	}
+	return false
+}
+
+// appendDirBlock adds an empty block to the end of dir and returns its
+// offset
+//
+// the caller must flush dir
+func (fs Fs) appendDirBlock(txn *txn, dir *inode) (uint64, error) {
+	b := dir.NBytes / disk.BlockSize
+	if err := fs.growInode(dir, dir.NBytes+disk.BlockSize); err != nil {
+		return 0, err
+	}
+	if err := fs.inodeWriteAlloc(txn, dir, b, newDirBlock()); err != nil {
+		return 0, err
+	}
+	return b, nil
+}
+
+// dxConvert turns a linear directory of one block into an indexed
+// directory, whose single leaf is the old block
+//
+// the caller must flush dir
+func (fs Fs) dxConvert(txn *txn, dir *inode) error {
+	block := fs.inodeRead(txn, dir, 0)
+	leaf, err := fs.appendDirBlock(txn, dir)
+	if err != nil {
+		return err
+	}
+	fs.inodeWrite(txn, dir, leaf, block)
+	root := &dxNode{Levels: 1, Entries: []dxEntry{{Hash: 0, Block: leaf}}}
+	fs.inodeWrite(txn, dir, 0, encodeDxNode(root))
+	dir.Flags |= INODE_FLAG_INDEXED
+	return nil
+}
+
+// dxAdd adds an entry to an indexed directory, splitting leaves as needed
+//
+// the caller must flush dir
+func (fs Fs) dxAdd(txn *txn, dir *inode, name string, i Inum) error {
+	h := nameHash(name)
+	for {
+		path, leaf := fs.dxLookup(txn, dir, h)
+		block := fs.inodeRead(txn, dir, leaf)
+		if addDirEnt(block, name, i) {
+			fs.inodeWrite(txn, dir, leaf, block)
+			return nil
+		}
+		err := fs.dxSplitLeaf(txn, dir, path, leaf, block, h)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// splitHash picks a hash to split a leaf at, such that some hashes are below
+// it and some at or above it
+//
+// hashes must be sorted; returns false if they are all the same
+func splitHash(hashes []uint64) (uint64, bool) {
+	mid := hashes[len(hashes)/2]
+	if mid != hashes[0] {
+		return mid, true
+	}
+	for _, h := range hashes {
+		if h > mid {
+			return h, true
+		}
+	}
+	return 0, false
+}
+
+// dxSplitLeaf moves the upper half (by hash) of a full leaf to a new block
+//
+// h is the hash of the entry being added, which is taken into account so
+// that it ends up in the emptier half
+func (fs Fs) dxSplitLeaf(txn *txn, dir *inode, path []dxStep,
+	leaf uint64, block disk.Block, h uint64) error {
+	var ents []dirEnt
+	hashes := []uint64{h}
+	for _, de := range decodeDirBlock(block) {
+		if de.I != 0 {
+			ents = append(ents, de)
+			hashes = append(hashes, nameHash(de.Name))
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	split, ok := splitHash(hashes)
+	if !ok {
+		// every name collides; there is no way to divide them
+		return ErrNoSpc
+	}
+	newLeaf, err := fs.appendDirBlock(txn, dir)
+	if err != nil {
+		return err
+	}
+	lower, upper := newDirBlock(), newDirBlock()
+	for _, de := range ents {
+		b := lower
+		if nameHash(de.Name) >= split {
+			b = upper
+		}
+		if !addDirEnt(b, de.Name, de.I) {
+			panic("entries should fit in a fresh block")
+		}
+	}
+	fs.inodeWrite(txn, dir, leaf, lower)
+	fs.inodeWrite(txn, dir, newLeaf, upper)
+	return fs.dxInsert(txn, dir, path, len(path)-1,
+		dxEntry{Hash: split, Block: newLeaf})
+}
+
+// dxInsert adds e to the index block at path[level], just after the entry
+// followed to get here, splitting index blocks (and adding a level at the
+// root) as needed
+func (fs Fs) dxInsert(txn *txn, dir *inode, path []dxStep,
+	level int, e dxEntry) error {
+	step := path[level]
+	node := step.node
+	node.insert(step.idx+1, e)
+	if uint64(len(node.Entries)) <= dxMaxEntries {
+		fs.inodeWrite(txn, dir, step.block, encodeDxNode(node))
+		return nil
+	}
+	if level == 0 {
+		if node.Levels == dxMaxLevels {
+			return ErrNoSpc
+		}
+		// move the root's entries to a new interior block, which then
+		// needs to be split
+		child, err := fs.appendDirBlock(txn, dir)
+		if err != nil {
+			return err
+		}
+		childNode := &dxNode{Entries: node.Entries}
+		node.Entries = []dxEntry{{Hash: 0, Block: child}}
+		node.Levels++
+		path = []dxStep{
+			{block: step.block, node: node, idx: 0},
+			{block: child, node: childNode},
+		}
+		level = 1
+		step = path[1]
+		node = childNode
+	}
+	newBlock, err := fs.appendDirBlock(txn, dir)
+	if err != nil {
+		return err
+	}
+	half := len(node.Entries) / 2
+	upper := &dxNode{Entries: append([]dxEntry{}, node.Entries[half:]...)}
+	node.Entries = node.Entries[:half]
+	fs.inodeWrite(txn, dir, step.block, encodeDxNode(node))
+	fs.inodeWrite(txn, dir, newBlock, encodeDxNode(upper))
+	return fs.dxInsert(txn, dir, path, level-1,
+		dxEntry{Hash: upper.Entries[0].Hash, Block: newBlock})
+}
@@ -0,0 +1,439 @@
+package nfs
+
+import (
+	"github.com/tchajed/goose/machine"
+	"github.com/tchajed/goose/machine/disk"
+)
+
+func (fs Fs) blockAddr(bn Bnum) uint64 {
+	return fs.sb.dataBase + bn - 1
+}
+
+// blockPath finds an offset in an inode in its tree of blocks
+//
+// returns the level of indirection (0 for a direct block) and the index to
+// follow in each block along the way, starting with the top-level indirect
+// block
+func blockPath(boff uint64) (int, []uint64) {
+	if boff < NumDirect {
+		return 0, []uint64{boff}
+	}
+	boff -= NumDirect
+	span := uint64(1)
+	for level := 1; level <= numIndirect; level++ {
+		span *= ptrsPerBlock
+		if boff < span {
+			path := make([]uint64, level)
+			for l := level - 1; l >= 0; l-- {
+				path[l] = boff % ptrsPerBlock
+				boff /= ptrsPerBlock
+			}
+			return level, path
+		}
+		boff -= span
+	}
+	panic("invalid block offset")
+}
+
+func getPtr(b disk.Block, i uint64) Bnum {
+	return machine.UInt64Get(b[i*8 : (i+1)*8])
+}
+
+func putPtr(b disk.Block, i uint64, bn Bnum) {
+	machine.UInt64Put(b[i*8:(i+1)*8], bn)
+}
+
+// btoa translates an offset in an inode to a block number
+//
+// returns 0 if the block is not allocated
+func (fs Fs) btoa(txn *txn, ino *inode, boff uint64) Bnum {
+	if ino.extents {
+		bn, _ := ino.lookupExtent(boff)
+		return bn
+	}
+	level, path := blockPath(boff)
+	if level == 0 {
+		return ino.Direct[path[0]]
+	}
+	bn := ino.Indirect[level-1]
+	for _, i := range path {
+		if bn == 0 {
+			return 0
+		}
+		bn = getPtr(txn.Read(fs.blockAddr(bn)), i)
+	}
+	return bn
+}
+
+// holeSpan is the number of blocks from path to the end of the subtree it
+// indexes into, all of which are holes if the subtree is not allocated
+func holeSpan(path []uint64) uint64 {
+	span := uint64(1)
+	pos := uint64(0)
+	for l := len(path) - 1; l >= 0; l-- {
+		pos += path[l] * span
+		span *= ptrsPerBlock
+	}
+	return span - pos
+}
+
+// blockRun finds the block for offset boff in ino, along with the number of
+// blocks from there on that are contiguous on disk
+//
+// in a hole, returns 0 and a number of blocks from boff on that are also in
+// the hole (at least 1)
+func (fs Fs) blockRun(txn *txn, ino *inode, boff uint64) (Bnum, uint64) {
+	if ino.extents {
+		return ino.lookupExtent(boff)
+	}
+	level, path := blockPath(boff)
+	if level == 0 {
+		bn := ino.Direct[boff]
+		n := uint64(1)
+		for boff+n < NumDirect {
+			next := ino.Direct[boff+n]
+			if (bn == 0 && next != 0) || (bn != 0 && next != bn+n) {
+				break
+			}
+			n++
+		}
+		return bn, n
+	}
+	bn := ino.Indirect[level-1]
+	for l, i := range path {
+		if bn == 0 {
+			return 0, holeSpan(path[l:])
+		}
+		bn = getPtr(txn.Read(fs.blockAddr(bn)), i)
+	}
+	return bn, 1
+}
+
+// allocRange allocates up to n contiguous zeroed blocks, at or after hint if
+// possible (or anywhere if hint is 0)
+//
+// returns the first block and the number allocated, which is less than n if
+// there is no free run of n blocks
+func (fs Fs) allocRange(txn *txn, blockA txnBitmap,
+	hint Bnum, n uint64) (Bnum, uint64, error) {
+	var bn Bnum
+	var l uint64
+	if hint == 0 {
+		bn, l = blockA.AllocRange(n)
+	} else {
+		bn, l = blockA.AllocRangeNear(hint, n)
+	}
+	if l == 0 {
+		return 0, 0, ErrNoSpc
+	}
+	// the blocks might have been used by a deleted file
+	zero := make(disk.Block, disk.BlockSize)
+	for k := uint64(0); k < l; k++ {
+		txn.Write(fs.blockAddr(bn+k), zero)
+	}
+	return bn, l, nil
+}
+
+// allocBlock allocates a zeroed block, at or after hint if possible (or
+// anywhere if hint is 0)
+func (fs Fs) allocBlock(txn *txn, blockA txnBitmap, hint Bnum) (Bnum, error) {
+	bn, _, err := fs.allocRange(txn, blockA, hint, 1)
+	return bn, err
+}
+
+// blockHint is where to look for a block for offset boff in ino: just after
+// the block for the previous offset, so that sequential writes are laid out
+// contiguously
+func (fs Fs) blockHint(txn *txn, ino *inode, boff uint64) Bnum {
+	if boff == 0 {
+		return 0
+	}
+	prev := fs.btoa(txn, ino, boff-1)
+	if prev == 0 {
+		return 0
+	}
+	return prev + 1
+}
+
+// mapBlock sets the block for offset boff in ino, which must be in a hole, to
+// bn, allocating any indirect blocks needed to reach it
+//
+// the caller must flush ino
+func (fs Fs) mapBlock(txn *txn, blockA txnBitmap,
+	ino *inode, boff uint64, bn Bnum) error {
+	level, path := blockPath(boff)
+	if level == 0 {
+		ino.Direct[path[0]] = bn
+		return nil
+	}
+	// indirect blocks go after the data, so they do not split up a run
+	hint := bn + 1
+	if ino.Indirect[level-1] == 0 {
+		ind, err := fs.allocBlock(txn, blockA, hint)
+		if err != nil {
+			return err
+		}
+		ino.Indirect[level-1] = ind
+	}
+	ind := ino.Indirect[level-1]
+	for l, i := range path {
+		b := txn.Read(fs.blockAddr(ind))
+		if l == len(path)-1 {
+			putPtr(b, i, bn)
+			txn.Write(fs.blockAddr(ind), b)
+			break
+		}
+		next := getPtr(b, i)
+		if next == 0 {
+			var err error
+			next, err = fs.allocBlock(txn, blockA, hint)
+			if err != nil {
+				return err
+			}
+			putPtr(b, i, next)
+			txn.Write(fs.blockAddr(ind), b)
+		}
+		ind = next
+	}
+	return nil
+}
+
+// allocInodeRange allocates data blocks for any holes among the n offsets
+// starting at boff in ino, laying out each hole as contiguously as the free
+// space allows
+//
+// the allocator is only locked if there is a hole; if this fails, the
+// operation must fail too, so its allocations are undone
+//
+// the caller must flush ino
+func (fs Fs) allocInodeRange(txn *txn, ino *inode, boff uint64, n uint64) error {
+	end := boff + n
+	for boff < end {
+		bn, run := fs.blockRun(txn, ino, boff)
+		if run > end-boff {
+			run = end - boff
+		}
+		if bn != 0 {
+			boff += run
+			continue
+		}
+		blockA := fs.blockAlloc(txn)
+		start, l, err := fs.allocRange(txn, blockA, fs.blockHint(txn, ino, boff), run)
+		if err != nil {
+			return err
+		}
+		if ino.extents {
+			ino.addExtent(extent{Off: boff, Start: start, Len: l})
+			if err := fs.fitExtentBlocks(txn, blockA, ino); err != nil {
+				return err
+			}
+		} else {
+			for k := uint64(0); k < l; k++ {
+				err := fs.mapBlock(txn, blockA, ino, boff+k, start+k)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		boff += l
+	}
+	return nil
+}
+
+// runFreer frees blocks, combining consecutive ones (in either order) into
+// a single range
+type runFreer struct {
+	blockA txnBitmap
+	start  Bnum
+	n      uint64
+}
+
+func (f *runFreer) free(bn Bnum) {
+	if f.n > 0 && f.start+f.n == bn {
+		f.n++
+		return
+	}
+	if f.n > 0 && bn+1 == f.start {
+		f.start = bn
+		f.n++
+		return
+	}
+	f.flush()
+	f.start, f.n = bn, 1
+}
+
+// flush frees the blocks not yet freed
+func (f *runFreer) flush() {
+	f.blockA.FreeRange(f.start, f.n)
+	f.n = 0
+}
+
+// freeTree frees the blocks for offsets keep and beyond in the tree rooted
+// at bn, which is at the given level of indirection and starts at offset
+// base
+//
+// returns true if bn itself was freed
+func (fs Fs) freeTree(txn *txn, f *runFreer,
+	bn Bnum, level int, base uint64, keep uint64) bool {
+	if level > 0 {
+		span := uint64(1)
+		for l := 1; l < level; l++ {
+			span *= ptrsPerBlock
+		}
+		b := txn.Read(fs.blockAddr(bn))
+		dirty := false
+		for i := uint64(0); i < ptrsPerBlock; i++ {
+			child := getPtr(b, i)
+			childBase := base + i*span
+			if child == 0 || childBase+span <= keep {
+				continue
+			}
+			if fs.freeTree(txn, f, child, level-1, childBase, keep) {
+				putPtr(b, i, 0)
+				dirty = true
+			}
+		}
+		if base < keep {
+			if dirty {
+				txn.Write(fs.blockAddr(bn), b)
+			}
+			return false
+		}
+	}
+	if base < keep {
+		return false
+	}
+	f.free(bn)
+	return true
+}
+
+// freeInodeBlocks frees all of the blocks for offsets keep and beyond in ino
+//
+// the caller must flush ino
+func (fs Fs) freeInodeBlocks(txn *txn, blockA txnBitmap,
+	ino *inode, keep uint64) {
+	if ino.extents {
+		fs.freeExtentBlocks(txn, blockA, ino, keep)
+		return
+	}
+	f := &runFreer{blockA: blockA}
+	for boff := keep; boff < NumDirect; boff++ {
+		if ino.Direct[boff] != 0 {
+			f.free(ino.Direct[boff])
+			ino.Direct[boff] = 0
+		}
+	}
+	base := uint64(NumDirect)
+	span := uint64(1)
+	for level := 1; level <= numIndirect; level++ {
+		span *= ptrsPerBlock
+		bn := ino.Indirect[level-1]
+		if bn != 0 && keep < base+span {
+			if fs.freeTree(txn, f, bn, level, base, keep) {
+				ino.Indirect[level-1] = 0
+			}
+		}
+		base += span
+	}
+	f.flush()
+}
+
+// freeTreeTail frees up to *budget blocks from the end of the tree rooted at
+// bn, which is at the given level of indirection and starts at offset base,
+// without freeing any for offsets below keep
+//
+// returns an offset from which the tree has no blocks left, and true if bn
+// itself was freed
+func (fs Fs) freeTreeTail(txn *txn, f *runFreer, bn Bnum, level int,
+	base uint64, keep uint64, budget *uint64) (uint64, bool) {
+	cut := base
+	if level > 0 {
+		span := uint64(1)
+		for l := 1; l < level; l++ {
+			span *= ptrsPerBlock
+		}
+		b := txn.Read(fs.blockAddr(bn))
+		dirty := false
+		cut = base + ptrsPerBlock*span
+		for i := ptrsPerBlock; i > 0 && cut > keep && *budget > 0; i-- {
+			child := getPtr(b, i-1)
+			childBase := base + (i-1)*span
+			if child == 0 {
+				cut = childBase
+				continue
+			}
+			childCut, freed := fs.freeTreeTail(txn, f, child, level-1,
+				childBase, keep, budget)
+			cut = childCut
+			if !freed {
+				break
+			}
+			putPtr(b, i-1, 0)
+			dirty = true
+		}
+		if cut > base || base < keep || *budget == 0 {
+			if dirty {
+				txn.Write(fs.blockAddr(bn), b)
+			}
+			return cut, false
+		}
+	}
+	if base < keep || *budget == 0 {
+		return base + 1, false
+	}
+	f.free(bn)
+	*budget--
+	return base, true
+}
+
+// freeInodeTail frees up to max of ino's blocks for offsets keep and beyond,
+// starting from the end of the file, so that a large file can be freed a
+// piece at a time
+//
+// returns an offset (at least keep) from which ino has no blocks left; the
+// caller must flush ino
+func (fs Fs) freeInodeTail(txn *txn, blockA txnBitmap,
+	ino *inode, keep uint64, max uint64) uint64 {
+	if ino.extents {
+		return fs.freeExtentTail(txn, blockA, ino, keep, max)
+	}
+	f := &runFreer{blockA: blockA}
+	budget := max
+	// the indirect blocks, from the last, then the direct blocks, each
+	// considered only once everything after it is gone
+	cut := uint64(MaxFileBlocks)
+	for level := numIndirect; level >= 1; level-- {
+		span := uint64(1)
+		for l := 1; l <= level; l++ {
+			span *= ptrsPerBlock
+		}
+		base := cut - span
+		bn := ino.Indirect[level-1]
+		if cut <= keep || budget == 0 {
+			break
+		}
+		if bn == 0 {
+			cut = base
+			continue
+		}
+		var freed bool
+		cut, freed = fs.freeTreeTail(txn, f, bn, level, base, keep, &budget)
+		if !freed {
+			break
+		}
+		ino.Indirect[level-1] = 0
+	}
+	for cut <= NumDirect && cut > keep && budget > 0 {
+		if bn := ino.Direct[cut-1]; bn != 0 {
+			f.free(bn)
+			budget--
+			ino.Direct[cut-1] = 0
+		}
+		cut--
+	}
+	f.flush()
+	if cut < keep {
+		return keep
+	}
+	return cut
+}
@@ -1,6 +1,8 @@
 package nfs
 
 import (
+	"time"
+
 	"github.com/tchajed/goose/machine/disk"
 
 	"github.com/tchajed/go-nfs/marshal"
@@ -9,24 +11,132 @@ import (
 const INODE_KIND_FREE uint64 = 0
 const INODE_KIND_DIR uint64 = 1
 const INODE_KIND_FILE uint64 = 2
+const INODE_KIND_SYMLINK uint64 = 3
+
+// INODE_FLAG_INDEXED marks a directory whose blocks are a hash index (see
+// htree.go) rather than a linear list of entries
+const INODE_FLAG_INDEXED uint64 = 1 << 0
 
 // note that 0 is an invalid Bnum
 type Bnum = uint64
 
-// inodes fit into one block, so there are exactly
-// (4096-8-8-8)/8 = 509 direct blocks
-const NumDirect = (4096 - 8 - 8 - 8) / 8
+// inodes fit into one block; after the 12 fixed fields there is room for 500
+// block pointers, the last three of which are for the indirect blocks
+const numIndirect = 3
+const NumDirect = (4096-12*8)/8 - numIndirect
+
+// an indirect block is an array of block pointers
+const ptrsPerBlock = disk.BlockSize / 8
+
+// MaxFileBlocks is the number of blocks addressable by an inode, through its
+// direct, single-, double- and triple-indirect blocks
+const MaxFileBlocks = NumDirect + ptrsPerBlock + ptrsPerBlock*ptrsPerBlock +
+	ptrsPerBlock*ptrsPerBlock*ptrsPerBlock
+
+// extent maps Len blocks of a file, starting at offset Off, to the
+// contiguous blocks starting at Start
+type extent struct {
+	Off   uint64
+	Start Bnum
+	Len   uint64
+}
+
+// with the extents feature, the space for block pointers instead holds the
+// address of the first extent block (see extent.go) followed by this many
+// extents
+const numExtents = (NumDirect + numIndirect - 1) / 3
+
+// symlink targets are stored in the inode, in place of the block pointers
+const MaxSymlinkLen = (NumDirect + numIndirect) * 8
+
+// MaxLinks is the largest link count of an inode
+const MaxLinks = 1<<16 - 1
+
+// Time is a timestamp with nanosecond precision, like an NFS nfstime3
+type Time struct {
+	Sec  uint32
+	Nsec uint32
+}
+
+func timeFromGo(t time.Time) Time {
+	return Time{Sec: uint32(t.Unix()), Nsec: uint32(t.Nanosecond())}
+}
+
+// now returns the current time, for timestamping inodes
+func now() Time {
+	return timeFromGo(time.Now())
+}
+
+// timestamps are stored in a single integer, seconds in the high bits
+func encodeTime(t Time) uint64 {
+	return uint64(t.Sec)<<32 | uint64(t.Nsec)
+}
+
+func decodeTime(x uint64) Time {
+	return Time{Sec: uint32(x >> 32), Nsec: uint32(x)}
+}
 
 type Attr struct {
-	// TODO: should probably store at least some permission attributes
-	IsDir bool
+	IsDir     bool
+	IsSymlink bool
+	// permission bits (including setuid, setgid and sticky), but not the
+	// file type
+	Mode   uint32
+	Uid    uint32
+	Gid    uint32
+	Size   uint64
+	Nlink  uint64
+	Fsid   uint64
+	Fileid uint64
+	Atime  Time
+	Mtime  Time
+	Ctime  Time
+}
+
+// SetAttrs describes the changes made by SetAttr; nil fields are left as-is
+type SetAttrs struct {
+	Mode  *uint32
+	Uid   *uint32
+	Gid   *uint32
+	Size  *uint64
+	Atime *Time
+	Mtime *Time
+	// set the timestamp to the current time, rather than Atime or Mtime
+	AtimeNow bool
+	MtimeNow bool
 }
 
 type inode struct {
 	Kind   uint64
-	Gen    uint64 // TODO: maintain this field
+	Gen    uint64 // incremented each time the inode is freed
 	NBytes uint64
+	// number of directory entries pointing to this inode; for directories,
+	// this includes each subdirectory's ".." and its own "."
+	Nlink uint64
+	// for directories, the directory containing this one (the root is its
+	// own parent)
+	Parent Inum
+	Mode   uint64
+	Uid    uint64
+	Gid    uint64
+	Atime  Time
+	Mtime  Time
+	Ctime  Time
+	Flags  uint64
 	Direct []Bnum
+	// single-, double- and triple-indirect blocks
+	Indirect [numIndirect]Bnum
+	// with the extents feature, the extents in use (instead of Direct and
+	// Indirect), sorted by offset
+	Extents []extent
+	// the extent blocks holding the extents past the first numExtents, in
+	// order; only the address of the first is stored in the inode
+	ExtentBlocks []Bnum
+	// for symlinks, the target (instead of Direct)
+	Target []byte
+
+	// in-memory only: whether this inode uses Extents
+	extents bool
 }
 
 // note that 0 is an invalid Inum
@@ -36,24 +146,99 @@ func newInode(kind uint64) inode {
 	return inode{Kind: kind, Direct: make([]Bnum, NumDirect)}
 }
 
+// init sets up a freshly-allocated inode with the given kind and mode
+func (ino *inode) init(kind uint64, mode uint64, t Time) {
+	ino.Kind = kind
+	ino.Mode = mode
+	ino.Atime = t
+	ino.Mtime = t
+	ino.Ctime = t
+}
+
+// modified records a change to ino's contents at time t
+func (ino *inode) modified(t Time) {
+	ino.Mtime = t
+	ino.Ctime = t
+}
+
 func encodeInode(ino inode) disk.Block {
-	if len(ino.Direct) != NumDirect {
+	if !ino.extents && len(ino.Direct) != NumDirect {
 		panic("invalid inode")
 	}
 	enc := marshal.NewEnc()
 	enc.PutInt(ino.Kind)
 	enc.PutInt(ino.Gen)
 	enc.PutInt(ino.NBytes)
-	enc.PutInts(ino.Direct)
+	enc.PutInt(ino.Nlink)
+	enc.PutInt(ino.Parent)
+	enc.PutInt(ino.Mode)
+	enc.PutInt(ino.Uid)
+	enc.PutInt(ino.Gid)
+	enc.PutInt(encodeTime(ino.Atime))
+	enc.PutInt(encodeTime(ino.Mtime))
+	enc.PutInt(encodeTime(ino.Ctime))
+	enc.PutInt(ino.Flags)
+	if ino.Kind == INODE_KIND_SYMLINK {
+		enc.PutBytes(ino.Target)
+	} else if ino.extents {
+		var first Bnum
+		if len(ino.ExtentBlocks) > 0 {
+			first = ino.ExtentBlocks[0]
+		}
+		enc.PutInt(first)
+		extents := ino.Extents
+		if len(extents) > numExtents {
+			extents = extents[:numExtents]
+		}
+		// unused extents are left as zeroes
+		for _, e := range extents {
+			enc.PutInt(e.Off)
+			enc.PutInt(e.Start)
+			enc.PutInt(e.Len)
+		}
+	} else {
+		enc.PutInts(ino.Direct)
+		enc.PutInts(ino.Indirect[:])
+	}
 	return enc.Finish()
 }
 
-func decodeInode(b disk.Block) inode {
-	ino := inode{}
+// decodeInode reads an inode, with the extent format if extents is true
+//
+// only the extents in the inode itself are decoded; ExtentBlocks has just
+// the first extent block, if any
+func decodeInode(b disk.Block, extents bool) inode {
+	ino := inode{extents: extents}
 	dec := marshal.NewDec(b)
 	ino.Kind = dec.GetInt()
 	ino.Gen = dec.GetInt()
 	ino.NBytes = dec.GetInt()
-	ino.Direct = dec.GetInts(NumDirect)
+	ino.Nlink = dec.GetInt()
+	ino.Parent = dec.GetInt()
+	ino.Mode = dec.GetInt()
+	ino.Uid = dec.GetInt()
+	ino.Gid = dec.GetInt()
+	ino.Atime = decodeTime(dec.GetInt())
+	ino.Mtime = decodeTime(dec.GetInt())
+	ino.Ctime = decodeTime(dec.GetInt())
+	ino.Flags = dec.GetInt()
+	if ino.Kind == INODE_KIND_SYMLINK {
+		ino.Target = append([]byte{}, dec.GetBytes(ino.NBytes)...)
+		ino.Direct = make([]Bnum, NumDirect)
+	} else if extents {
+		if first := dec.GetInt(); first != 0 {
+			ino.ExtentBlocks = []Bnum{first}
+		}
+		for i := 0; i < numExtents; i++ {
+			e := extent{Off: dec.GetInt(), Start: dec.GetInt(), Len: dec.GetInt()}
+			if e.Len == 0 {
+				break
+			}
+			ino.Extents = append(ino.Extents, e)
+		}
+	} else {
+		ino.Direct = dec.GetInts(NumDirect)
+		copy(ino.Indirect[:], dec.GetInts(numIndirect))
+	}
 	return ino
 }
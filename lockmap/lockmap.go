@@ -0,0 +1,55 @@
+// Package lockmap provides a lock for each key in a large space of keys,
+// such as inode numbers, using memory only for the keys that are locked.
+package lockmap
+
+import (
+	"sync"
+)
+
+type LockMap struct {
+	mu   *sync.Mutex
+	cond *sync.Cond
+	held map[uint64]bool
+}
+
+func New() *LockMap {
+	mu := new(sync.Mutex)
+	return &LockMap{
+		mu:   mu,
+		cond: sync.NewCond(mu),
+		held: make(map[uint64]bool),
+	}
+}
+
+// Acquire waits until k is free and then locks it
+func (lm *LockMap) Acquire(k uint64) {
+	lm.mu.Lock()
+	for lm.held[k] {
+		lm.cond.Wait()
+	}
+	lm.held[k] = true
+	lm.mu.Unlock()
+}
+
+// TryAcquire locks k if it is free, and otherwise returns false without
+// waiting
+func (lm *LockMap) TryAcquire(k uint64) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.held[k] {
+		return false
+	}
+	lm.held[k] = true
+	return true
+}
+
+// Release unlocks k, which must be locked
+func (lm *LockMap) Release(k uint64) {
+	lm.mu.Lock()
+	if !lm.held[k] {
+		panic("lockmap: release of unlocked key")
+	}
+	delete(lm.held, k)
+	lm.mu.Unlock()
+	lm.cond.Broadcast()
+}
@@ -0,0 +1,40 @@
+package lockmap
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTryAcquire(t *testing.T) {
+	assert := assert.New(t)
+	lm := New()
+	assert.True(lm.TryAcquire(1))
+	assert.False(lm.TryAcquire(1))
+	assert.True(lm.TryAcquire(2), "keys should be independent")
+	lm.Release(1)
+	assert.True(lm.TryAcquire(1))
+	assert.Panics(func() { lm.Release(3) })
+}
+
+func TestMutualExclusion(t *testing.T) {
+	assert := assert.New(t)
+	lm := New()
+	counts := make([]int, 4)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				k := uint64(n % len(counts))
+				lm.Acquire(k)
+				counts[k]++
+				lm.Release(k)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal([]int{2000, 2000, 2000, 2000}, counts)
+}
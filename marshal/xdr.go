@@ -0,0 +1,254 @@
+package marshal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// XDR encoding (RFC 4506), as used by ONC RPC and NFS
+//
+// Unlike Enc and Dec, XDR data is big-endian, padded to multiples of 4 bytes,
+// and not limited to a single block.
+
+var (
+	ErrXdrShort   = errors.New("xdr: short input")
+	ErrXdrTooLong = errors.New("xdr: length exceeds maximum")
+	ErrXdrUnion   = errors.New("xdr: invalid union discriminant")
+)
+
+type XdrEnc struct {
+	b []byte
+}
+
+func NewXdrEnc() *XdrEnc {
+	return &XdrEnc{}
+}
+
+func (enc *XdrEnc) PutUint32(x uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], x)
+	enc.b = append(enc.b, buf[:]...)
+}
+
+func (enc *XdrEnc) PutInt32(x int32) {
+	enc.PutUint32(uint32(x))
+}
+
+// PutUint64 encodes an unsigned hyper integer
+func (enc *XdrEnc) PutUint64(x uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	enc.b = append(enc.b, buf[:]...)
+}
+
+func (enc *XdrEnc) PutInt64(x int64) {
+	enc.PutUint64(uint64(x))
+}
+
+func (enc *XdrEnc) PutBool(b bool) {
+	if b {
+		enc.PutUint32(1)
+	} else {
+		enc.PutUint32(0)
+	}
+}
+
+// PutFixedOpaque encodes data whose length is known to the decoder
+func (enc *XdrEnc) PutFixedOpaque(b []byte) {
+	enc.b = append(enc.b, b...)
+	for i := len(b); i%4 != 0; i++ {
+		enc.b = append(enc.b, 0)
+	}
+}
+
+// PutOpaque encodes variable-length data, prefixed with its length
+func (enc *XdrEnc) PutOpaque(b []byte) {
+	enc.PutUint32(uint32(len(b)))
+	enc.PutFixedOpaque(b)
+}
+
+func (enc *XdrEnc) PutString(s string) {
+	enc.PutOpaque([]byte(s))
+}
+
+// PutArray encodes a variable-length array of n elements, calling put to
+// encode each element
+func (enc *XdrEnc) PutArray(n int, put func(i int)) {
+	enc.PutUint32(uint32(n))
+	for i := 0; i < n; i++ {
+		put(i)
+	}
+}
+
+// PutOptional encodes optional data (*T in XDR), calling put to encode the
+// data if present
+func (enc *XdrEnc) PutOptional(present bool, put func()) {
+	enc.PutBool(present)
+	if present {
+		put()
+	}
+}
+
+// PutUnion encodes a discriminated union, calling put (if non-nil) to
+// encode the arm for disc
+func (enc *XdrEnc) PutUnion(disc uint32, put func()) {
+	enc.PutUint32(disc)
+	if put != nil {
+		put()
+	}
+}
+
+func (enc *XdrEnc) Len() int {
+	return len(enc.b)
+}
+
+func (enc *XdrEnc) Finish() []byte {
+	return enc.b
+}
+
+// XdrDec decodes XDR data from a buffer
+//
+// The first error (for example, running out of input) is recorded and
+// returned by Err; after an error every Get returns a zero value, so
+// callers can decode an entire structure and check for errors once.
+type XdrDec struct {
+	b   []byte
+	err error
+}
+
+func NewXdrDec(b []byte) *XdrDec {
+	return &XdrDec{b: b}
+}
+
+func (dec *XdrDec) Err() error {
+	return dec.err
+}
+
+// Fail records err as the decoding error, unless there already is one
+//
+// This is useful for reporting invalid values found by the caller.
+func (dec *XdrDec) Fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+		dec.b = nil
+	}
+}
+
+// Remaining returns the number of undecoded bytes
+func (dec *XdrDec) Remaining() int {
+	return len(dec.b)
+}
+
+func (dec *XdrDec) take(n uint64) []byte {
+	if dec.err != nil {
+		return nil
+	}
+	if uint64(len(dec.b)) < n {
+		dec.Fail(ErrXdrShort)
+		return nil
+	}
+	b := dec.b[:n]
+	dec.b = dec.b[n:]
+	return b
+}
+
+func (dec *XdrDec) GetUint32() uint32 {
+	b := dec.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (dec *XdrDec) GetInt32() int32 {
+	return int32(dec.GetUint32())
+}
+
+func (dec *XdrDec) GetUint64() uint64 {
+	b := dec.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (dec *XdrDec) GetInt64() int64 {
+	return int64(dec.GetUint64())
+}
+
+func (dec *XdrDec) GetBool() bool {
+	return dec.GetUint32() != 0
+}
+
+// GetFixedOpaque decodes n bytes of data (and their padding)
+//
+// The result aliases the input buffer.
+func (dec *XdrDec) GetFixedOpaque(n uint64) []byte {
+	b := dec.take((n + 3) / 4 * 4)
+	if b == nil {
+		return nil
+	}
+	return b[:n]
+}
+
+// GetOpaque decodes variable-length data of at most max bytes
+func (dec *XdrDec) GetOpaque(max uint32) []byte {
+	n := dec.GetUint32()
+	if n > max {
+		dec.Fail(ErrXdrTooLong)
+		return nil
+	}
+	return dec.GetFixedOpaque(uint64(n))
+}
+
+func (dec *XdrDec) GetString(max uint32) string {
+	return string(dec.GetOpaque(max))
+}
+
+// GetArray decodes a variable-length array of at most max elements,
+// calling get to decode each element
+//
+// returns the number of elements
+func (dec *XdrDec) GetArray(max uint32, get func(i int)) int {
+	n := dec.GetUint32()
+	if n > max {
+		dec.Fail(ErrXdrTooLong)
+		return 0
+	}
+	for i := 0; i < int(n) && dec.err == nil; i++ {
+		get(i)
+	}
+	if dec.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// GetOptional decodes optional data, calling get if the data is present
+func (dec *XdrDec) GetOptional(get func()) bool {
+	present := dec.GetBool()
+	if present && dec.err == nil {
+		get()
+	}
+	return present && dec.err == nil
+}
+
+// GetUnion decodes a discriminated union, calling the arm for the
+// discriminant
+//
+// A nil arm is a void arm. A discriminant without an arm is an error.
+func (dec *XdrDec) GetUnion(arms map[uint32]func()) uint32 {
+	disc := dec.GetUint32()
+	if dec.err != nil {
+		return 0
+	}
+	get, ok := arms[disc]
+	if !ok {
+		dec.Fail(ErrXdrUnion)
+		return 0
+	}
+	if get != nil {
+		get()
+	}
+	return disc
+}
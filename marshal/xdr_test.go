@@ -0,0 +1,173 @@
+package marshal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testXdrRoundTrip(t *testing.T,
+	expected interface{},
+	encF func(enc *XdrEnc),
+	decF func(dec *XdrDec) interface{}) {
+	t.Helper()
+	enc := NewXdrEnc()
+	encF(enc)
+	if enc.Len()%4 != 0 {
+		t.Errorf("encoding has length %d, not a multiple of 4", enc.Len())
+	}
+	dec := NewXdrDec(enc.Finish())
+	actual := decF(dec)
+	if dec.Err() != nil {
+		t.Fatalf("decoding failed: %v", dec.Err())
+	}
+	if dec.Remaining() != 0 {
+		t.Errorf("%d bytes left after decoding", dec.Remaining())
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("got %v, expected %v", actual, expected)
+	}
+}
+
+func TestXdrEncoding(t *testing.T) {
+	enc := NewXdrEnc()
+	enc.PutUint32(0x01020304)
+	enc.PutUint64(0x05060708090a0b0c)
+	enc.PutBool(true)
+	enc.PutString("abcde")
+	expected := []byte{
+		1, 2, 3, 4,
+		5, 6, 7, 8, 9, 10, 11, 12,
+		0, 0, 0, 1,
+		0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e', 0, 0, 0,
+	}
+	if !reflect.DeepEqual(expected, enc.Finish()) {
+		t.Errorf("got %v, expected %v", enc.Finish(), expected)
+	}
+}
+
+func TestXdrInts(t *testing.T) {
+	for _, x := range []uint64{0, 1, 1<<32 + 7, 1<<63 + 1<<20} {
+		testXdrRoundTrip(t, x, func(enc *XdrEnc) {
+			enc.PutUint64(x)
+		}, func(dec *XdrDec) interface{} {
+			return dec.GetUint64()
+		})
+	}
+	testXdrRoundTrip(t, []int32{-3, 4}, func(enc *XdrEnc) {
+		enc.PutInt32(-3)
+		enc.PutInt32(4)
+	}, func(dec *XdrDec) interface{} {
+		return []int32{dec.GetInt32(), dec.GetInt32()}
+	})
+	testXdrRoundTrip(t, int64(-1<<40), func(enc *XdrEnc) {
+		enc.PutInt64(-1 << 40)
+	}, func(dec *XdrDec) interface{} {
+		return dec.GetInt64()
+	})
+}
+
+func TestXdrOpaque(t *testing.T) {
+	for _, x := range [][]byte{{}, {1}, {1, 2, 3, 4}, {1, 2, 3, 4, 5, 6}} {
+		testXdrRoundTrip(t, x, func(enc *XdrEnc) {
+			enc.PutOpaque(x)
+		}, func(dec *XdrDec) interface{} {
+			return append([]byte{}, dec.GetOpaque(10)...)
+		})
+		testXdrRoundTrip(t, x, func(enc *XdrEnc) {
+			enc.PutFixedOpaque(x)
+		}, func(dec *XdrDec) interface{} {
+			return append([]byte{}, dec.GetFixedOpaque(uint64(len(x)))...)
+		})
+	}
+}
+
+type xdrVarious struct {
+	a uint32
+	b string
+	c bool
+	d []uint64
+	e *uint32
+}
+
+func TestXdrVarious(t *testing.T) {
+	seven := uint32(7)
+	for _, x := range []xdrVarious{
+		{3, "foo", true, []uint64{1, 2, 3}, &seven},
+		{0, "", false, []uint64{}, nil},
+	} {
+		testXdrRoundTrip(t, x, func(enc *XdrEnc) {
+			enc.PutUint32(x.a)
+			enc.PutString(x.b)
+			enc.PutBool(x.c)
+			enc.PutArray(len(x.d), func(i int) {
+				enc.PutUint64(x.d[i])
+			})
+			enc.PutOptional(x.e != nil, func() {
+				enc.PutUint32(*x.e)
+			})
+		}, func(dec *XdrDec) interface{} {
+			var x xdrVarious
+			x.a = dec.GetUint32()
+			x.b = dec.GetString(100)
+			x.c = dec.GetBool()
+			x.d = make([]uint64, 0)
+			dec.GetArray(10, func(i int) {
+				x.d = append(x.d, dec.GetUint64())
+			})
+			dec.GetOptional(func() {
+				e := dec.GetUint32()
+				x.e = &e
+			})
+			return x
+		})
+	}
+}
+
+func TestXdrUnion(t *testing.T) {
+	for _, disc := range []uint32{1, 2} {
+		testXdrRoundTrip(t, disc, func(enc *XdrEnc) {
+			enc.PutUnion(disc, func() {
+				if disc == 1 {
+					enc.PutString("one")
+				}
+			})
+		}, func(dec *XdrDec) interface{} {
+			return dec.GetUnion(map[uint32]func(){
+				1: func() { dec.GetString(3) },
+				2: nil,
+			})
+		})
+	}
+}
+
+func TestXdrErrors(t *testing.T) {
+	dec := NewXdrDec([]byte{0, 0, 0})
+	if dec.GetUint32() != 0 || dec.Err() != ErrXdrShort {
+		t.Errorf("short uint32 should fail")
+	}
+
+	// length prefix says 8 bytes, but only 4 follow
+	dec = NewXdrDec([]byte{0, 0, 0, 8, 1, 2, 3, 4})
+	if dec.GetOpaque(100) != nil || dec.Err() != ErrXdrShort {
+		t.Errorf("short opaque should fail")
+	}
+
+	dec = NewXdrDec([]byte{0, 0, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8})
+	dec.GetOpaque(4)
+	if dec.Err() != ErrXdrTooLong {
+		t.Errorf("opaque beyond maximum should fail")
+	}
+
+	dec = NewXdrDec([]byte{0, 0, 0, 3})
+	dec.GetUnion(map[uint32]func(){1: nil})
+	if dec.Err() != ErrXdrUnion {
+		t.Errorf("unknown discriminant should fail")
+	}
+
+	// errors are sticky
+	dec = NewXdrDec([]byte{0, 0, 0, 5, 0, 0})
+	dec.GetUint64()
+	if dec.GetUint32() != 0 || dec.Err() != ErrXdrShort {
+		t.Errorf("decoding after an error should fail")
+	}
+}
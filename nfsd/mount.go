@@ -0,0 +1,77 @@
+package nfsd
+
+import "github.com/tchajed/go-nfs/marshal"
+
+// MOUNT version 3 protocol (RFC 1813, Appendix I)
+//
+// There is a single export, "/", and the server keeps no record of mounts.
+
+const (
+	mountProgram = 100005
+	mountVersion = 3
+)
+
+const (
+	mountProcNull    = 0
+	mountProcMnt     = 1
+	mountProcDump    = 2
+	mountProcUmnt    = 3
+	mountProcUmntAll = 4
+	mountProcExport  = 5
+)
+
+// mountstat3
+const (
+	mnt3Ok       uint32 = 0
+	mnt3ErrNoEnt uint32 = 2
+)
+
+const authSys uint32 = 1
+
+const (
+	mntPathLen = 1024
+	exportPath = "/"
+)
+
+var mountProcs = map[uint32]procHandler{
+	mountProcNull:    (*Server).null,
+	mountProcMnt:     (*Server).mnt,
+	mountProcDump:    (*Server).mntDump,
+	mountProcUmnt:    (*Server).umnt,
+	mountProcUmntAll: (*Server).null,
+	mountProcExport:  (*Server).mntExport,
+}
+
+func (s *Server) mnt(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	path := args.GetString(mntPathLen)
+	if args.Err() != nil {
+		return
+	}
+	if path != exportPath {
+		res.PutUint32(mnt3ErrNoEnt)
+		return
+	}
+	res.PutUint32(mnt3Ok)
+	putFh(res, s.fs.InumToHandle(s.fs.RootInode()))
+	// auth_flavors
+	res.PutUint32(1)
+	res.PutUint32(authSys)
+}
+
+func (s *Server) mntDump(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	// empty mount list
+	res.PutBool(false)
+}
+
+func (s *Server) umnt(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	args.GetString(mntPathLen)
+}
+
+func (s *Server) mntExport(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	res.PutBool(true)
+	res.PutString(exportPath)
+	// no groups
+	res.PutBool(false)
+	// end of export list
+	res.PutBool(false)
+}
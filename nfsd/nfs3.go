@@ -0,0 +1,209 @@
+package nfsd
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+
+	nfs "github.com/tchajed/go-nfs"
+	"github.com/tchajed/go-nfs/marshal"
+)
+
+// NFS version 3 protocol definitions (RFC 1813)
+
+const (
+	nfsProgram = 100003
+	nfsVersion = 3
+)
+
+const (
+	nfsProcNull        = 0
+	nfsProcGetAttr     = 1
+	nfsProcSetAttr     = 2
+	nfsProcLookup      = 3
+	nfsProcAccess      = 4
+	nfsProcReadlink    = 5
+	nfsProcRead        = 6
+	nfsProcWrite       = 7
+	nfsProcCreate      = 8
+	nfsProcMkdir       = 9
+	nfsProcSymlink     = 10
+	nfsProcMknod       = 11
+	nfsProcRemove      = 12
+	nfsProcRmdir       = 13
+	nfsProcRename      = 14
+	nfsProcLink        = 15
+	nfsProcReaddir     = 16
+	nfsProcReaddirPlus = 17
+	nfsProcFsStat      = 18
+	nfsProcFsInfo      = 19
+	nfsProcPathConf    = 20
+	nfsProcCommit      = 21
+)
+
+// nfsstat3 for success; errors are nfs.Error values
+const nfs3Ok uint32 = 0
+
+// ftype3
+const (
+	nf3Reg  uint32 = 1
+	nf3Dir  uint32 = 2
+	nf3Blk  uint32 = 3
+	nf3Chr  uint32 = 4
+	nf3Lnk  uint32 = 5
+	nf3Sock uint32 = 6
+	nf3Fifo uint32 = 7
+)
+
+// createmode3
+const (
+	createUnchecked uint32 = 0
+	createGuarded   uint32 = 1
+	createExclusive uint32 = 2
+)
+
+// stable_how
+const fileSync uint32 = 2
+
+// ACCESS3 bits
+const (
+	access3Read    uint32 = 0x01
+	access3Lookup  uint32 = 0x02
+	access3Modify  uint32 = 0x04
+	access3Extend  uint32 = 0x08
+	access3Delete  uint32 = 0x10
+	access3Execute uint32 = 0x20
+)
+
+// FSINFO3 properties
+const (
+	fsf3Link        uint32 = 0x1
+	fsf3Symlink     uint32 = 0x2
+	fsf3Homogeneous uint32 = 0x8
+	fsf3CanSetTime  uint32 = 0x10
+)
+
+const (
+	nfs3FhSize       = 64
+	nfs3CookieVerfSz = 8
+	nfs3CreateVerfSz = 8
+	nfs3WriteVerfSz  = 8
+)
+
+// maximum size of a READ or WRITE, and preferred READDIR size
+const (
+	maxIOSize      = nfs.MaxIOSize
+	prefReaddirLen = 8 * 1024
+)
+
+// maximum length of names and paths we accept in arguments
+const maxPathLen = 4096
+
+func putFh(enc *marshal.XdrEnc, fh nfs.Fh) {
+	enc.PutOpaque(fh.Encode())
+}
+
+func getFh(dec *marshal.XdrDec) []byte {
+	return dec.GetOpaque(nfs3FhSize)
+}
+
+func putTime(enc *marshal.XdrEnc, t nfs.Time) {
+	enc.PutUint32(t.Sec)
+	enc.PutUint32(t.Nsec)
+}
+
+// putFattr encodes attr as an fattr3
+func putFattr(enc *marshal.XdrEnc, attr nfs.Attr) {
+	if attr.IsDir {
+		enc.PutUint32(nf3Dir)
+	} else if attr.IsSymlink {
+		enc.PutUint32(nf3Lnk)
+	} else {
+		enc.PutUint32(nf3Reg)
+	}
+	enc.PutUint32(attr.Mode)
+	enc.PutUint32(uint32(attr.Nlink))
+	enc.PutUint32(attr.Uid)
+	enc.PutUint32(attr.Gid)
+	enc.PutUint64(attr.Size)
+	// used
+	enc.PutUint64((attr.Size + disk.BlockSize - 1) / disk.BlockSize * disk.BlockSize)
+	// rdev
+	enc.PutUint32(0)
+	enc.PutUint32(0)
+	enc.PutUint64(attr.Fsid)
+	enc.PutUint64(attr.Fileid)
+	putTime(enc, attr.Atime)
+	putTime(enc, attr.Mtime)
+	putTime(enc, attr.Ctime)
+}
+
+func putPostOpAttr(enc *marshal.XdrEnc, attr nfs.Attr, ok bool) {
+	enc.PutBool(ok)
+	if ok {
+		putFattr(enc, attr)
+	}
+}
+
+func putNoAttr(enc *marshal.XdrEnc) {
+	enc.PutBool(false)
+}
+
+// putNoWcc encodes an empty wcc_data
+func putNoWcc(enc *marshal.XdrEnc) {
+	enc.PutBool(false) // pre_op_attr
+	enc.PutBool(false) // post_op_attr
+}
+
+func putPostOpFh(enc *marshal.XdrEnc, fh nfs.Fh) {
+	enc.PutBool(true)
+	putFh(enc, fh)
+}
+
+// time_how
+const (
+	dontChange      uint32 = 0
+	setToServerTime uint32 = 1
+	setToClientTime uint32 = 2
+)
+
+func getTime(dec *marshal.XdrDec) nfs.Time {
+	var t nfs.Time
+	t.Sec = dec.GetUint32()
+	t.Nsec = dec.GetUint32()
+	return t
+}
+
+// getSetTime decodes a set_atime or set_mtime
+func getSetTime(dec *marshal.XdrDec) (now bool, t *nfs.Time) {
+	dec.GetUnion(map[uint32]func(){
+		dontChange:      nil,
+		setToServerTime: func() { now = true },
+		setToClientTime: func() {
+			clientTime := getTime(dec)
+			t = &clientTime
+		},
+	})
+	return
+}
+
+func getSattr(dec *marshal.XdrDec) nfs.SetAttrs {
+	var attrs nfs.SetAttrs
+	dec.GetOptional(func() {
+		mode := dec.GetUint32()
+		attrs.Mode = &mode
+	})
+	dec.GetOptional(func() {
+		uid := dec.GetUint32()
+		attrs.Uid = &uid
+	})
+	dec.GetOptional(func() {
+		gid := dec.GetUint32()
+		attrs.Gid = &gid
+	})
+	dec.GetOptional(func() {
+		size := dec.GetUint64()
+		attrs.Size = &size
+	})
+	attrs.AtimeNow, attrs.Atime = getSetTime(dec)
+	attrs.MtimeNow, attrs.Mtime = getSetTime(dec)
+	return attrs
+}
@@ -0,0 +1,141 @@
+package nfsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/tchajed/go-nfs/marshal"
+)
+
+// ONC RPC version 2 (RFC 5531)
+
+const rpcVersion = 2
+
+const (
+	msgCall  uint32 = 0
+	msgReply uint32 = 1
+)
+
+const (
+	replyAccepted uint32 = 0
+	replyDenied   uint32 = 1
+)
+
+const (
+	acceptSuccess      uint32 = 0
+	acceptProgUnavail  uint32 = 1
+	acceptProgMismatch uint32 = 2
+	acceptProcUnavail  uint32 = 3
+	acceptGarbageArgs  uint32 = 4
+	acceptSystemErr    uint32 = 5
+)
+
+const rejectRpcMismatch uint32 = 0
+
+const authNone uint32 = 0
+
+// maximum size of the body of an opaque_auth
+const maxAuthBytes = 400
+
+// upper bound on a whole record, to protect against bad clients
+const maxRecordSize = 4 << 20
+
+var errRecordTooLarge = errors.New("rpc: record too large")
+
+// readRecord reads one message using the record marking standard for
+// stream transports (RFC 5531, section 11)
+func readRecord(r io.Reader) ([]byte, error) {
+	var rec []byte
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		x := binary.BigEndian.Uint32(hdr[:])
+		last := x&(1<<31) != 0
+		n := uint64(x &^ (1 << 31))
+		if uint64(len(rec))+n > maxRecordSize {
+			return nil, errRecordTooLarge
+		}
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(r, frag); err != nil {
+			return nil, err
+		}
+		rec = append(rec, frag...)
+		if last {
+			return rec, nil
+		}
+	}
+}
+
+// writeRecord sends msg as a single fragment
+func writeRecord(w io.Writer, msg []byte) error {
+	buf := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(buf, 1<<31|uint32(len(msg)))
+	buf = append(buf, msg...)
+	_, err := w.Write(buf)
+	return err
+}
+
+type callHeader struct {
+	xid     uint32
+	rpcvers uint32
+	prog    uint32
+	vers    uint32
+	proc    uint32
+}
+
+// decodeCall decodes the header of a call message, leaving dec at the
+// procedure arguments
+//
+// credentials and verifiers are decoded but not checked.
+func decodeCall(dec *marshal.XdrDec) (callHeader, bool) {
+	var h callHeader
+	h.xid = dec.GetUint32()
+	if dec.GetUint32() != msgCall {
+		return h, false
+	}
+	h.rpcvers = dec.GetUint32()
+	h.prog = dec.GetUint32()
+	h.vers = dec.GetUint32()
+	h.proc = dec.GetUint32()
+	// credential
+	dec.GetUint32()
+	dec.GetOpaque(maxAuthBytes)
+	// verifier
+	dec.GetUint32()
+	dec.GetOpaque(maxAuthBytes)
+	return h, dec.Err() == nil
+}
+
+// acceptedReply starts a reply to xid with the given accept status; the
+// caller appends any results
+func acceptedReply(xid uint32, stat uint32) *marshal.XdrEnc {
+	enc := marshal.NewXdrEnc()
+	enc.PutUint32(xid)
+	enc.PutUint32(msgReply)
+	enc.PutUint32(replyAccepted)
+	enc.PutUint32(authNone)
+	enc.PutOpaque(nil)
+	enc.PutUint32(stat)
+	return enc
+}
+
+func progMismatchReply(xid uint32, low uint32, high uint32) *marshal.XdrEnc {
+	enc := acceptedReply(xid, acceptProgMismatch)
+	enc.PutUint32(low)
+	enc.PutUint32(high)
+	return enc
+}
+
+func rpcMismatchReply(xid uint32) *marshal.XdrEnc {
+	enc := marshal.NewXdrEnc()
+	enc.PutUint32(xid)
+	enc.PutUint32(msgReply)
+	enc.PutUint32(replyDenied)
+	enc.PutUint32(rejectRpcMismatch)
+	enc.PutUint32(rpcVersion)
+	enc.PutUint32(rpcVersion)
+	return enc
+}
@@ -0,0 +1,910 @@
+// Package nfsd serves an nfs.Fs over the network using NFS version 3.
+//
+// The server speaks ONC RPC over TCP and implements both the NFS program
+// and the MOUNT program needed to obtain the root file handle.
+package nfsd
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	nfs "github.com/tchajed/go-nfs"
+	"github.com/tchajed/go-nfs/marshal"
+)
+
+type Server struct {
+	fs nfs.Fs
+	// identifies this server instance in WRITE and COMMIT replies
+	writeVerf []byte
+}
+
+func NewServer(fs nfs.Fs) *Server {
+	verf := make([]byte, nfs3WriteVerfSz)
+	binary.BigEndian.PutUint64(verf, uint64(time.Now().UnixNano()))
+	return &Server{fs: fs, writeVerf: verf}
+}
+
+// Serve accepts connections on ln and handles their requests
+//
+// Serve only returns when ln.Accept fails, for example because ln was closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		rec, err := readRecord(conn)
+		if err != nil {
+			return
+		}
+		reply := s.handle(rec)
+		if reply == nil {
+			// not a well-formed call, which RPC says to ignore
+			continue
+		}
+		if err := writeRecord(conn, reply.Finish()); err != nil {
+			return
+		}
+	}
+}
+
+type procHandler func(s *Server, args *marshal.XdrDec, res *marshal.XdrEnc)
+
+var nfsProcs = map[uint32]procHandler{
+	nfsProcNull:        (*Server).null,
+	nfsProcGetAttr:     (*Server).getAttr,
+	nfsProcSetAttr:     (*Server).setAttr,
+	nfsProcLookup:      (*Server).lookup,
+	nfsProcAccess:      (*Server).access,
+	nfsProcReadlink:    (*Server).readlink,
+	nfsProcRead:        (*Server).read,
+	nfsProcWrite:       (*Server).write,
+	nfsProcCreate:      (*Server).create,
+	nfsProcMkdir:       (*Server).mkdir,
+	nfsProcSymlink:     (*Server).symlink,
+	nfsProcMknod:       (*Server).mknod,
+	nfsProcRemove:      (*Server).remove,
+	nfsProcRmdir:       (*Server).rmdir,
+	nfsProcRename:      (*Server).rename,
+	nfsProcLink:        (*Server).link,
+	nfsProcReaddir:     (*Server).readdir,
+	nfsProcReaddirPlus: (*Server).readdirPlus,
+	nfsProcFsStat:      (*Server).fsStat,
+	nfsProcFsInfo:      (*Server).fsInfo,
+	nfsProcPathConf:    (*Server).pathConf,
+	nfsProcCommit:      (*Server).commit,
+}
+
+func (s *Server) handle(rec []byte) *marshal.XdrEnc {
+	args := marshal.NewXdrDec(rec)
+	h, ok := decodeCall(args)
+	if !ok {
+		return nil
+	}
+	if h.rpcvers != rpcVersion {
+		return rpcMismatchReply(h.xid)
+	}
+	var procs map[uint32]procHandler
+	var vers uint32
+	switch h.prog {
+	case nfsProgram:
+		procs, vers = nfsProcs, nfsVersion
+	case mountProgram:
+		procs, vers = mountProcs, mountVersion
+	default:
+		return acceptedReply(h.xid, acceptProgUnavail)
+	}
+	if h.vers != vers {
+		return progMismatchReply(h.xid, vers, vers)
+	}
+	f, ok := procs[h.proc]
+	if !ok {
+		return acceptedReply(h.xid, acceptProcUnavail)
+	}
+	res := acceptedReply(h.xid, acceptSuccess)
+	if !s.run(f, args, res) {
+		return acceptedReply(h.xid, acceptSystemErr)
+	}
+	if args.Err() != nil {
+		return acceptedReply(h.xid, acceptGarbageArgs)
+	}
+	return res
+}
+
+// run calls a procedure, reporting false if it panicked
+func (s *Server) run(f procHandler, args *marshal.XdrDec, res *marshal.XdrEnc) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("nfsd: procedure failed: %v", r)
+			ok = false
+		}
+	}()
+	f(s, args, res)
+	return true
+}
+
+// status converts an error from the file system to an nfsstat3
+func status(err error) uint32 {
+	if err == nil {
+		return nfs3Ok
+	}
+	if e, ok := err.(nfs.Error); ok {
+		return uint32(e)
+	}
+	return uint32(nfs.ErrServerFault)
+}
+
+// getInode resolves a file handle to an existing inode
+func (s *Server) getInode(fh []byte) (nfs.Inum, nfs.Attr, error) {
+	h, err := nfs.DecodeFh(fh)
+	if err != nil {
+		return 0, nfs.Attr{}, err
+	}
+	i, err := s.fs.HandleToInum(h)
+	if err != nil {
+		return 0, nfs.Attr{}, err
+	}
+	attr, err := s.fs.GetAttr(i)
+	return i, attr, err
+}
+
+func (s *Server) putAttr(res *marshal.XdrEnc, i nfs.Inum) {
+	attr, err := s.fs.GetAttr(i)
+	putPostOpAttr(res, attr, err == nil)
+}
+
+// putWcc encodes wcc_data with only the post-operation attributes
+func (s *Server) putWcc(res *marshal.XdrEnc, i nfs.Inum) {
+	res.PutBool(false)
+	s.putAttr(res, i)
+}
+
+func (s *Server) null(args *marshal.XdrDec, res *marshal.XdrEnc) {}
+
+func (s *Server) getAttr(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	if args.Err() != nil {
+		return
+	}
+	_, attr, err := s.getInode(fh)
+	res.PutUint32(status(err))
+	if err != nil {
+		return
+	}
+	putFattr(res, attr)
+}
+
+func (s *Server) setAttr(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	attrs := getSattr(args)
+	var guard *nfs.Time
+	args.GetOptional(func() {
+		ctime := getTime(args)
+		guard = &ctime
+	})
+	if args.Err() != nil {
+		return
+	}
+	i, _, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoWcc(res)
+		return
+	}
+	err = s.fs.SetAttr(i, attrs, guard)
+	res.PutUint32(status(err))
+	s.putWcc(res, i)
+}
+
+func (s *Server) lookup(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	name := args.GetString(maxPathLen)
+	if args.Err() != nil {
+		return
+	}
+	dir, dirAttr, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoAttr(res)
+		return
+	}
+	i, err := s.fs.Lookup(dir, name)
+	if err != nil {
+		res.PutUint32(status(err))
+		putPostOpAttr(res, dirAttr, true)
+		return
+	}
+	res.PutUint32(nfs3Ok)
+	putFh(res, s.fs.InumToHandle(i))
+	s.putAttr(res, i)
+	putPostOpAttr(res, dirAttr, true)
+}
+
+func (s *Server) access(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	mask := args.GetUint32()
+	if args.Err() != nil {
+		return
+	}
+	_, attr, err := s.getInode(fh)
+	res.PutUint32(status(err))
+	if err != nil {
+		putNoAttr(res)
+		return
+	}
+	putPostOpAttr(res, attr, true)
+	// there are no permissions, so everything is allowed
+	res.PutUint32(mask & (access3Read | access3Lookup | access3Modify |
+		access3Extend | access3Delete | access3Execute))
+}
+
+func (s *Server) read(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	off := args.GetUint64()
+	count := args.GetUint32()
+	if args.Err() != nil {
+		return
+	}
+	i, attr, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoAttr(res)
+		return
+	}
+	if count > maxIOSize {
+		count = maxIOSize
+	}
+	data, eof, err := s.fs.Read(i, off, uint64(count))
+	res.PutUint32(status(err))
+	putPostOpAttr(res, attr, true)
+	if err != nil {
+		return
+	}
+	res.PutUint32(uint32(len(data)))
+	res.PutBool(eof)
+	res.PutOpaque(data)
+}
+
+func (s *Server) write(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	off := args.GetUint64()
+	count := args.GetUint32()
+	args.GetUint32() // stable; all writes are synchronous
+	data := args.GetOpaque(maxIOSize)
+	if args.Err() != nil {
+		return
+	}
+	i, _, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoWcc(res)
+		return
+	}
+	if uint64(count) < uint64(len(data)) {
+		data = data[:count]
+	}
+	err = s.fs.Write(i, off, data)
+	res.PutUint32(status(err))
+	s.putWcc(res, i)
+	if err != nil {
+		return
+	}
+	res.PutUint32(uint32(len(data)))
+	res.PutUint32(fileSync)
+	res.PutFixedOpaque(s.writeVerf)
+}
+
+// getDirOp decodes diropargs3 and resolves the directory handle
+func (s *Server) getDirOp(args *marshal.XdrDec) (nfs.Inum, string, error) {
+	fh := getFh(args)
+	name := args.GetString(maxPathLen)
+	if args.Err() != nil {
+		return 0, "", args.Err()
+	}
+	dir, _, err := s.getInode(fh)
+	if err != nil {
+		return 0, "", err
+	}
+	return dir, name, nil
+}
+
+// attrSetter is an nfs.Fs or an *nfs.Txn
+type attrSetter interface {
+	SetAttr(i nfs.Inum, attrs nfs.SetAttrs, guard *nfs.Time) error
+}
+
+// setInitialAttrs applies the attributes given when creating i
+func setInitialAttrs(fs attrSetter, i nfs.Inum, attrs nfs.SetAttrs) error {
+	if attrs == (nfs.SetAttrs{}) {
+		return nil
+	}
+	return fs.SetAttr(i, attrs, nil)
+}
+
+// verfAttrs stores an exclusive create's verifier in a file's atime and
+// mtime (as knfsd does), so a retransmitted request can tell that the file
+// is the one it created
+func verfAttrs(verf []byte) nfs.SetAttrs {
+	atime := nfs.Time{Sec: binary.BigEndian.Uint32(verf[0:4])}
+	mtime := nfs.Time{Sec: binary.BigEndian.Uint32(verf[4:8])}
+	return nfs.SetAttrs{Atime: &atime, Mtime: &mtime}
+}
+
+// createFile creates name in dir as part of t, following how
+//
+// GUARDED fails if name exists. UNCHECKED instead applies attrs to an
+// existing file, and EXCLUSIVE (where attrs hold the verifier) succeeds if
+// the existing file has the same verifier.
+func createFile(t *nfs.Txn, dir nfs.Inum, name string,
+	how uint32, attrs nfs.SetAttrs) (nfs.Inum, error) {
+	i, err := t.Create(dir, name, false)
+	if err == nil {
+		return i, setInitialAttrs(t, i, attrs)
+	}
+	if err != nfs.ErrExist || how == createGuarded {
+		return 0, err
+	}
+	i, err = t.Lookup(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	attr, err := t.GetAttr(i)
+	if err != nil {
+		return 0, err
+	}
+	if attr.IsDir || attr.IsSymlink {
+		return 0, nfs.ErrExist
+	}
+	if how == createExclusive {
+		if attr.Atime != *attrs.Atime || attr.Mtime != *attrs.Mtime {
+			return 0, nfs.ErrExist
+		}
+		// a retransmission of the request that created the file
+		return i, nil
+	}
+	return i, setInitialAttrs(t, i, attrs)
+}
+
+func (s *Server) create(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	dir, name, err := s.getDirOp(args)
+	var attrs nfs.SetAttrs
+	getAttrs := func() { attrs = getSattr(args) }
+	how := args.GetUnion(map[uint32]func(){
+		createUnchecked: getAttrs,
+		createGuarded:   getAttrs,
+		createExclusive: func() {
+			if verf := args.GetFixedOpaque(nfs3CreateVerfSz); verf != nil {
+				attrs = verfAttrs(verf)
+			}
+		},
+	})
+	if args.Err() != nil {
+		return
+	}
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoWcc(res)
+		return
+	}
+	t := s.fs.Begin()
+	i, err := createFile(t, dir, name, how, attrs)
+	if err == nil {
+		t.Commit()
+	} else {
+		t.Abort()
+	}
+	res.PutUint32(status(err))
+	if err == nil {
+		putPostOpFh(res, s.fs.InumToHandle(i))
+		s.putAttr(res, i)
+	}
+	s.putWcc(res, dir)
+}
+
+func (s *Server) mkdir(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	dir, name, err := s.getDirOp(args)
+	attrs := getSattr(args)
+	if args.Err() != nil {
+		return
+	}
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoWcc(res)
+		return
+	}
+	t := s.fs.Begin()
+	i, err := t.Mkdir(dir, name)
+	if err == nil {
+		err = setInitialAttrs(t, i, attrs)
+	}
+	if err == nil {
+		t.Commit()
+	} else {
+		t.Abort()
+	}
+	res.PutUint32(status(err))
+	if err == nil {
+		putPostOpFh(res, s.fs.InumToHandle(i))
+		s.putAttr(res, i)
+	}
+	s.putWcc(res, dir)
+}
+
+func (s *Server) symlink(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	dir, name, err := s.getDirOp(args)
+	attrs := getSattr(args)
+	target := args.GetString(maxPathLen)
+	if args.Err() != nil {
+		return
+	}
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoWcc(res)
+		return
+	}
+	t := s.fs.Begin()
+	i, err := t.Symlink(dir, name, target)
+	if err == nil {
+		err = setInitialAttrs(t, i, attrs)
+	}
+	if err == nil {
+		t.Commit()
+	} else {
+		t.Abort()
+	}
+	res.PutUint32(status(err))
+	if err == nil {
+		putPostOpFh(res, s.fs.InumToHandle(i))
+		s.putAttr(res, i)
+	}
+	s.putWcc(res, dir)
+}
+
+// mknod decodes MKNOD, but the file system has no special files to create
+func (s *Server) mknod(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	getFh(args)
+	args.GetString(maxPathLen)
+	getAttrs := func() { getSattr(args) }
+	getDevice := func() {
+		getSattr(args)
+		args.GetUint32() // specdata1
+		args.GetUint32() // specdata2
+	}
+	args.GetUnion(map[uint32]func(){
+		nf3Reg:  nil,
+		nf3Dir:  nil,
+		nf3Blk:  getDevice,
+		nf3Chr:  getDevice,
+		nf3Lnk:  nil,
+		nf3Sock: getAttrs,
+		nf3Fifo: getAttrs,
+	})
+	if args.Err() != nil {
+		return
+	}
+	res.PutUint32(status(nfs.ErrNotSupp))
+	putNoWcc(res)
+}
+
+func (s *Server) readlink(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	if args.Err() != nil {
+		return
+	}
+	i, attr, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoAttr(res)
+		return
+	}
+	target, err := s.fs.Readlink(i)
+	res.PutUint32(status(err))
+	putPostOpAttr(res, attr, true)
+	if err != nil {
+		return
+	}
+	res.PutString(target)
+}
+
+// removeEntry implements REMOVE (for files) and RMDIR (for directories)
+func (s *Server) removeEntry(args *marshal.XdrDec, res *marshal.XdrEnc, wantDir bool) {
+	dir, name, err := s.getDirOp(args)
+	if args.Err() != nil {
+		return
+	}
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoWcc(res)
+		return
+	}
+	if !wantDir {
+		// so that removing a large file fits in one transaction
+		if err := s.fs.PrepareRemove(dir, name); err != nil {
+			res.PutUint32(status(err))
+			s.putWcc(res, dir)
+			return
+		}
+	}
+	// in one transaction, so name cannot be replaced after it is checked
+	t := s.fs.Begin()
+	err = checkRemove(t, dir, name, wantDir)
+	if err == nil {
+		err = t.Remove(dir, name)
+	}
+	t.Commit()
+	res.PutUint32(status(err))
+	s.putWcc(res, dir)
+}
+
+// checkRemove checks that name is a directory if and only if wantDir, as
+// part of t
+func checkRemove(t *nfs.Txn, dir nfs.Inum, name string, wantDir bool) error {
+	if name == "." || name == ".." {
+		return nfs.ErrInval
+	}
+	i, err := t.Lookup(dir, name)
+	if err != nil {
+		return err
+	}
+	attr, err := t.GetAttr(i)
+	if err != nil {
+		return err
+	}
+	if attr.IsDir && !wantDir {
+		return nfs.ErrIsDir
+	}
+	if !attr.IsDir && wantDir {
+		return nfs.ErrNotDir
+	}
+	return nil
+}
+
+func (s *Server) remove(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	s.removeEntry(args, res, false)
+}
+
+func (s *Server) rmdir(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	s.removeEntry(args, res, true)
+}
+
+func (s *Server) rename(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	srcDir, srcName, srcErr := s.getDirOp(args)
+	dstDir, dstName, dstErr := s.getDirOp(args)
+	if args.Err() != nil {
+		return
+	}
+	err := srcErr
+	if err == nil {
+		err = dstErr
+	}
+	if err == nil {
+		err = s.fs.Rename(srcDir, srcName, dstDir, dstName)
+	}
+	res.PutUint32(status(err))
+	if srcErr == nil {
+		s.putWcc(res, srcDir)
+	} else {
+		putNoWcc(res)
+	}
+	if dstErr == nil {
+		s.putWcc(res, dstDir)
+	} else {
+		putNoWcc(res)
+	}
+}
+
+func (s *Server) link(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	dir, name, dirErr := s.getDirOp(args)
+	if args.Err() != nil {
+		return
+	}
+	i, _, err := s.getInode(fh)
+	if err == nil {
+		err = dirErr
+	}
+	if err == nil {
+		err = s.fs.Link(i, dir, name)
+	}
+	res.PutUint32(status(err))
+	if i != 0 {
+		s.putAttr(res, i)
+	} else {
+		putNoAttr(res)
+	}
+	if dirErr == nil {
+		s.putWcc(res, dir)
+	} else {
+		putNoWcc(res)
+	}
+}
+
+// size of a READDIR or READDIRPLUS reply without entries: status,
+// dir_attributes (a bool and 84-byte fattr3), verifier, list terminator and eof
+const readdirReplySize = uint32(4 + (4 + 84) + nfs3CookieVerfSz + 4 + 4)
+
+// sizes of the "." and ".." entries in a READDIR reply (an entry3, whose
+// name is padded to 4 bytes) and in a READDIRPLUS reply (which adds a
+// post_op_attr and post_op_fh3)
+const dotEntrySize = uint32(4 + 8 + (4 + 4) + 8)
+const dotPlusEntrySize = dotEntrySize + (4 + 84) + (4 + 4 + nfs.FhSize)
+
+// dotEntries returns the entries for "." and ".." in dir that come after
+// cookie
+//
+// they are listed before the entries from the Fs, at cookies 1 and 2 (which
+// the Fs does not use)
+func (s *Server) dotEntries(dir nfs.Inum, cookie uint64) ([]nfs.DirPlusEntry, error) {
+	if cookie >= 2 {
+		return nil, nil
+	}
+	parent, err := s.fs.Lookup(dir, "..")
+	if err != nil {
+		return nil, err
+	}
+	var dots []nfs.DirPlusEntry
+	for k, e := range []nfs.DirEntry{
+		{Name: ".", I: dir, Cookie: 1},
+		{Name: "..", I: parent, Cookie: 2},
+	} {
+		attr, err := s.fs.GetAttr(e.I)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(k) >= cookie {
+			dots = append(dots, nfs.DirPlusEntry{
+				DirEntry: e,
+				Fh:       s.fs.InumToHandle(e.I),
+				Attr:     attr,
+			})
+		}
+	}
+	return dots, nil
+}
+
+// fsCookie converts a READDIR cookie to one for the Fs, which starts over
+// after "." and ".."
+func fsCookie(cookie uint64) uint64 {
+	if cookie <= 2 {
+		return 0
+	}
+	return cookie
+}
+
+// fitDots is how many of dots fit in maxBytes, at size bytes each
+func fitDots(dots []nfs.DirPlusEntry, size uint32, maxBytes uint32) int {
+	n := int(maxBytes / size)
+	if n > len(dots) {
+		return len(dots)
+	}
+	return n
+}
+
+// listDir is Fs.Readdir, with "." and ".." first
+func (s *Server) listDir(dir nfs.Inum, cookie uint64, verf uint64, maxBytes uint32) (nfs.DirPage, error) {
+	dots, err := s.dotEntries(dir, cookie)
+	if err != nil {
+		return nfs.DirPage{}, err
+	}
+	n := fitDots(dots, dotEntrySize, maxBytes)
+	var page nfs.DirPage
+	if n == len(dots) {
+		page, err = s.fs.Readdir(dir, fsCookie(cookie), verf,
+			uint64(maxBytes-uint32(n)*dotEntrySize))
+		// the dots can make up the page by themselves
+		if err != nil && (err != nfs.ErrTooSmall || n == 0) {
+			return nfs.DirPage{}, err
+		}
+	} else if n == 0 {
+		return nfs.DirPage{}, nfs.ErrTooSmall
+	}
+	entries := make([]nfs.DirEntry, 0, n+len(page.Entries))
+	for _, e := range dots[:n] {
+		entries = append(entries, e.DirEntry)
+	}
+	page.Entries = append(entries, page.Entries...)
+	return page, nil
+}
+
+// listDirPlus is like listDir, for Fs.ReaddirPlus
+func (s *Server) listDirPlus(dir nfs.Inum, cookie uint64, verf uint64, maxBytes uint32) (nfs.DirPlusPage, error) {
+	dots, err := s.dotEntries(dir, cookie)
+	if err != nil {
+		return nfs.DirPlusPage{}, err
+	}
+	n := fitDots(dots, dotPlusEntrySize, maxBytes)
+	var page nfs.DirPlusPage
+	if n == len(dots) {
+		page, err = s.fs.ReaddirPlus(dir, fsCookie(cookie), verf,
+			uint64(maxBytes-uint32(n)*dotPlusEntrySize))
+		if err != nil && (err != nfs.ErrTooSmall || n == 0) {
+			return nfs.DirPlusPage{}, err
+		}
+	} else if n == 0 {
+		return nfs.DirPlusPage{}, nfs.ErrTooSmall
+	}
+	page.Entries = append(dots[:n:n], page.Entries...)
+	return page, nil
+}
+
+func (s *Server) readdir(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	cookie := args.GetUint64()
+	verf := args.GetUint64()
+	count := args.GetUint32()
+	if args.Err() != nil {
+		return
+	}
+	dir, attr, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoAttr(res)
+		return
+	}
+	var page nfs.DirPage
+	if count < readdirReplySize {
+		err = nfs.ErrTooSmall
+	} else {
+		page, err = s.listDir(dir, cookie, verf, count-readdirReplySize)
+	}
+	res.PutUint32(status(err))
+	putPostOpAttr(res, attr, true)
+	if err != nil {
+		return
+	}
+	res.PutUint64(page.Verifier)
+	for _, e := range page.Entries {
+		res.PutBool(true)
+		res.PutUint64(e.I)
+		res.PutString(e.Name)
+		res.PutUint64(e.Cookie)
+	}
+	res.PutBool(false)
+	res.PutBool(page.Eof)
+}
+
+func (s *Server) readdirPlus(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	cookie := args.GetUint64()
+	verf := args.GetUint64()
+	// dircount only limits the directory information, which maxcount also
+	// accounts for
+	args.GetUint32()
+	maxcount := args.GetUint32()
+	if args.Err() != nil {
+		return
+	}
+	dir, attr, err := s.getInode(fh)
+	if err != nil {
+		res.PutUint32(status(err))
+		putNoAttr(res)
+		return
+	}
+	var page nfs.DirPlusPage
+	if maxcount < readdirReplySize {
+		err = nfs.ErrTooSmall
+	} else {
+		page, err = s.listDirPlus(dir, cookie, verf, maxcount-readdirReplySize)
+	}
+	res.PutUint32(status(err))
+	putPostOpAttr(res, attr, true)
+	if err != nil {
+		return
+	}
+	res.PutUint64(page.Verifier)
+	for _, e := range page.Entries {
+		res.PutBool(true)
+		res.PutUint64(e.I)
+		res.PutString(e.Name)
+		res.PutUint64(e.Cookie)
+		putPostOpAttr(res, e.Attr, true)
+		putPostOpFh(res, e.Fh)
+	}
+	res.PutBool(false)
+	res.PutBool(page.Eof)
+}
+
+func (s *Server) fsStat(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	if args.Err() != nil {
+		return
+	}
+	_, attr, err := s.getInode(fh)
+	res.PutUint32(status(err))
+	if err != nil {
+		putNoAttr(res)
+		return
+	}
+	putPostOpAttr(res, attr, true)
+	stat := s.fs.FsStat()
+	res.PutUint64(stat.TotalBytes)
+	res.PutUint64(stat.FreeBytes)
+	res.PutUint64(stat.AvailBytes)
+	res.PutUint64(stat.TotalFiles)
+	res.PutUint64(stat.FreeFiles)
+	res.PutUint64(stat.FreeFiles) // afiles
+	res.PutUint32(0)              // invarsec: the counts can change at any time
+}
+
+func (s *Server) fsInfo(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	if args.Err() != nil {
+		return
+	}
+	_, attr, err := s.getInode(fh)
+	res.PutUint32(status(err))
+	if err != nil {
+		putNoAttr(res)
+		return
+	}
+	putPostOpAttr(res, attr, true)
+	info := s.fs.FsInfo()
+	res.PutUint32(uint32(info.MaxRead))
+	res.PutUint32(uint32(info.PrefRead))
+	res.PutUint32(uint32(info.BlockSize)) // rtmult
+	res.PutUint32(uint32(info.MaxWrite))
+	res.PutUint32(uint32(info.PrefWrite))
+	res.PutUint32(uint32(info.BlockSize)) // wtmult
+	res.PutUint32(prefReaddirLen)
+	res.PutUint64(info.MaxFileSize)
+	putTime(res, info.TimeDelta)
+	// every file has the same properties
+	props := fsf3Homogeneous
+	if info.Links {
+		props |= fsf3Link
+	}
+	if info.Symlinks {
+		props |= fsf3Symlink
+	}
+	if info.CanSetTime {
+		props |= fsf3CanSetTime
+	}
+	res.PutUint32(props)
+}
+
+func (s *Server) pathConf(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	if args.Err() != nil {
+		return
+	}
+	_, attr, err := s.getInode(fh)
+	res.PutUint32(status(err))
+	if err != nil {
+		putNoAttr(res)
+		return
+	}
+	putPostOpAttr(res, attr, true)
+	res.PutUint32(nfs.MaxLinks)
+	res.PutUint32(nfs.MaxNameLen)
+	res.PutBool(true)  // no_trunc
+	res.PutBool(true)  // chown_restricted
+	res.PutBool(false) // case_insensitive
+	res.PutBool(true)  // case_preserving
+}
+
+func (s *Server) commit(args *marshal.XdrDec, res *marshal.XdrEnc) {
+	fh := getFh(args)
+	args.GetUint64() // offset
+	args.GetUint32() // count
+	if args.Err() != nil {
+		return
+	}
+	i, _, err := s.getInode(fh)
+	res.PutUint32(status(err))
+	if err != nil {
+		putNoWcc(res)
+		return
+	}
+	// every operation is committed to the log before replying
+	s.putWcc(res, i)
+	res.PutFixedOpaque(s.writeVerf)
+}
@@ -0,0 +1,826 @@
+package nfsd
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/tchajed/go-awol/mem"
+
+	nfs "github.com/tchajed/go-nfs"
+	"github.com/tchajed/go-nfs/marshal"
+)
+
+// client is a minimal RPC client for exercising the server
+type client struct {
+	conn net.Conn
+	xid  uint32
+}
+
+// rawCall sends a call and returns the accept status and a decoder for the
+// results
+func (c *client) rawCall(prog, vers, proc uint32, args []byte) (uint32, *marshal.XdrDec, error) {
+	c.xid++
+	enc := marshal.NewXdrEnc()
+	enc.PutUint32(c.xid)
+	enc.PutUint32(msgCall)
+	enc.PutUint32(rpcVersion)
+	enc.PutUint32(prog)
+	enc.PutUint32(vers)
+	enc.PutUint32(proc)
+	// AUTH_NONE credential and verifier
+	enc.PutUint32(authNone)
+	enc.PutOpaque(nil)
+	enc.PutUint32(authNone)
+	enc.PutOpaque(nil)
+	enc.PutFixedOpaque(args)
+	if err := writeRecord(c.conn, enc.Finish()); err != nil {
+		return 0, nil, err
+	}
+	rec, err := readRecord(c.conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	dec := marshal.NewXdrDec(rec)
+	if dec.GetUint32() != c.xid ||
+		dec.GetUint32() != msgReply ||
+		dec.GetUint32() != replyAccepted {
+		return 0, nil, errors.New("unexpected reply header")
+	}
+	dec.GetUint32()
+	dec.GetOpaque(maxAuthBytes)
+	stat := dec.GetUint32()
+	return stat, dec, dec.Err()
+}
+
+type ServerSuite struct {
+	suite.Suite
+	fs nfs.Fs
+	ln net.Listener
+	c  *client
+}
+
+func (suite *ServerSuite) SetupTest() {
+	suite.fs = nfs.NewFs(mem.New(10 * 1000))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	suite.ln = ln
+	go NewServer(suite.fs).Serve(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	suite.Require().NoError(err)
+	suite.c = &client{conn: conn}
+}
+
+func (suite *ServerSuite) TearDownTest() {
+	suite.c.conn.Close()
+	suite.ln.Close()
+}
+
+// call makes a successful NFS call
+func (suite *ServerSuite) call(proc uint32, args *marshal.XdrEnc) *marshal.XdrDec {
+	suite.T().Helper()
+	stat, res, err := suite.c.rawCall(nfsProgram, nfsVersion, proc, args.Finish())
+	suite.Require().NoError(err)
+	suite.Require().Equal(acceptSuccess, stat, "accept status")
+	return res
+}
+
+func (suite *ServerSuite) rootFh() []byte {
+	stat, res, err := suite.c.rawCall(mountProgram, mountVersion,
+		mountProcMnt, func() []byte {
+			enc := marshal.NewXdrEnc()
+			enc.PutString("/")
+			return enc.Finish()
+		}())
+	suite.Require().NoError(err)
+	suite.Require().Equal(acceptSuccess, stat)
+	suite.Require().Equal(mnt3Ok, res.GetUint32())
+	return getFh(res)
+}
+
+func dirOpArgs(dir []byte, name string) *marshal.XdrEnc {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(dir)
+	args.PutString(name)
+	return args
+}
+
+// skipFattr decodes an fattr3, returning its type and size
+func skipFattr(dec *marshal.XdrDec) (uint32, uint64) {
+	ftype := dec.GetUint32()
+	dec.GetFixedOpaque(4 * 4) // mode, nlink, uid, gid
+	size := dec.GetUint64()
+	dec.GetFixedOpaque(84 - 4*5 - 8)
+	return ftype, size
+}
+
+func skipPostOpAttr(dec *marshal.XdrDec) {
+	if dec.GetBool() {
+		skipFattr(dec)
+	}
+}
+
+func skipWcc(dec *marshal.XdrDec) {
+	if dec.GetBool() {
+		dec.GetFixedOpaque(8 + 8 + 8)
+	}
+	skipPostOpAttr(dec)
+}
+
+func (suite *ServerSuite) getAttr(fh []byte) (uint32, uint32, uint64) {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	res := suite.call(nfsProcGetAttr, args)
+	stat := res.GetUint32()
+	if stat != nfs3Ok {
+		return stat, 0, 0
+	}
+	ftype, size := skipFattr(res)
+	suite.Require().NoError(res.Err())
+	return stat, ftype, size
+}
+
+func (suite *ServerSuite) lookup(dir []byte, name string) (uint32, []byte) {
+	res := suite.call(nfsProcLookup, dirOpArgs(dir, name))
+	stat := res.GetUint32()
+	if stat != nfs3Ok {
+		return stat, nil
+	}
+	return stat, getFh(res)
+}
+
+func (suite *ServerSuite) create(dir []byte, name string, how uint32) (uint32, []byte) {
+	return suite.createWith(dir, name, how, func(args *marshal.XdrEnc) {
+		// empty sattr3
+		for i := 0; i < 6; i++ {
+			args.PutUint32(0)
+		}
+	})
+}
+
+// createWith is like create, but encodes the rest of createhow3 with put
+func (suite *ServerSuite) createWith(dir []byte, name string, how uint32,
+	put func(args *marshal.XdrEnc)) (uint32, []byte) {
+	args := dirOpArgs(dir, name)
+	args.PutUint32(how)
+	put(args)
+	res := suite.call(nfsProcCreate, args)
+	stat := res.GetUint32()
+	if stat != nfs3Ok {
+		return stat, nil
+	}
+	suite.Require().True(res.GetBool(), "should return handle")
+	return stat, getFh(res)
+}
+
+func (suite *ServerSuite) mkdir(dir []byte, name string) (uint32, []byte) {
+	args := dirOpArgs(dir, name)
+	for i := 0; i < 6; i++ {
+		args.PutUint32(0)
+	}
+	res := suite.call(nfsProcMkdir, args)
+	stat := res.GetUint32()
+	if stat != nfs3Ok {
+		return stat, nil
+	}
+	suite.Require().True(res.GetBool(), "should return handle")
+	return stat, getFh(res)
+}
+
+// readdir lists dir using READDIR calls of at most count bytes
+func (suite *ServerSuite) readdir(dir []byte, count uint32) []string {
+	var names []string
+	cookie := uint64(0)
+	verf := uint64(0)
+	for {
+		args := marshal.NewXdrEnc()
+		args.PutOpaque(dir)
+		args.PutUint64(cookie)
+		args.PutUint64(verf)
+		args.PutUint32(count)
+		res := suite.call(nfsProcReaddir, args)
+		suite.Require().Equal(nfs3Ok, res.GetUint32())
+		skipPostOpAttr(res)
+		verf = res.GetUint64()
+		for res.GetBool() {
+			res.GetUint64()
+			names = append(names, res.GetString(maxPathLen))
+			cookie = res.GetUint64()
+		}
+		eof := res.GetBool()
+		suite.Require().NoError(res.Err())
+		if eof {
+			return names
+		}
+	}
+}
+
+func (suite *ServerSuite) TestNull() {
+	res := suite.call(nfsProcNull, marshal.NewXdrEnc())
+	suite.NoError(res.Err())
+}
+
+func (suite *ServerSuite) TestMountRoot() {
+	root := suite.rootFh()
+	stat, ftype, _ := suite.getAttr(root)
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(nf3Dir, ftype)
+}
+
+func (suite *ServerSuite) TestCreateLookup() {
+	root := suite.rootFh()
+	stat, fh := suite.create(root, "foo", createGuarded)
+	suite.Require().Equal(nfs3Ok, stat)
+	stat, fh2 := suite.lookup(root, "foo")
+	suite.Require().Equal(nfs3Ok, stat)
+	suite.Equal(fh, fh2)
+	stat, ftype, size := suite.getAttr(fh)
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(nf3Reg, ftype)
+	suite.Equal(uint64(0), size)
+
+	stat, _ = suite.lookup(root, "bar")
+	suite.Equal(uint32(nfs.ErrNoEnt), stat)
+}
+
+func (suite *ServerSuite) TestFsid() {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(suite.rootFh())
+	res := suite.call(nfsProcGetAttr, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	// type, mode, nlink, uid, gid, size, used and rdev
+	res.GetFixedOpaque(4*5 + 8*3)
+	suite.Equal(suite.fs.FsId(), res.GetUint64())
+	suite.NoError(res.Err())
+}
+
+func (suite *ServerSuite) TestCreateGuarded() {
+	root := suite.rootFh()
+	stat, _ := suite.create(root, "foo", createGuarded)
+	suite.Require().Equal(nfs3Ok, stat)
+	stat, _ = suite.create(root, "foo", createGuarded)
+	suite.Equal(uint32(nfs.ErrExist), stat)
+	stat, _ = suite.create(root, "foo", createUnchecked)
+	suite.Equal(nfs3Ok, stat)
+}
+
+func (suite *ServerSuite) TestCreateUnchecked() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	stat, _ := suite.write(fh, 0, []byte("hello"))
+	suite.Require().Equal(nfs3Ok, stat)
+	// sets the size to 0
+	stat, fh2 := suite.createWith(root, "foo", createUnchecked, func(args *marshal.XdrEnc) {
+		args.PutBool(false) // mode
+		args.PutBool(false) // uid
+		args.PutBool(false) // gid
+		args.PutBool(true)
+		args.PutUint64(0)
+		args.PutUint32(dontChange) // atime
+		args.PutUint32(dontChange) // mtime
+	})
+	suite.Require().Equal(nfs3Ok, stat)
+	suite.Equal(fh, fh2, "should return the existing file")
+	stat, _, size := suite.getAttr(fh)
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(uint64(0), size)
+
+	suite.mkdir(root, "dir")
+	stat, _ = suite.create(root, "dir", createUnchecked)
+	suite.Equal(uint32(nfs.ErrExist), stat)
+}
+
+func (suite *ServerSuite) TestCreateExclusive() {
+	root := suite.rootFh()
+	createExcl := func(verf uint64) (uint32, []byte) {
+		return suite.createWith(root, "foo", createExclusive, func(args *marshal.XdrEnc) {
+			args.PutUint64(verf)
+		})
+	}
+	stat, fh := createExcl(1)
+	suite.Require().Equal(nfs3Ok, stat)
+	stat, fh2 := createExcl(1)
+	suite.Require().Equal(nfs3Ok, stat, "retransmission should succeed")
+	suite.Equal(fh, fh2)
+	stat, _ = createExcl(2)
+	suite.Equal(uint32(nfs.ErrExist), stat)
+}
+
+func (suite *ServerSuite) TestMkdirReaddir() {
+	root := suite.rootFh()
+	stat, dir := suite.mkdir(root, "dir")
+	suite.Require().Equal(nfs3Ok, stat)
+	expected := []string{".", ".."}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		stat, _ := suite.create(dir, name, createGuarded)
+		suite.Require().Equal(nfs3Ok, stat)
+		expected = append(expected, name)
+	}
+	stat, _ = suite.create(root, "f", createGuarded)
+	suite.Require().Equal(nfs3Ok, stat)
+
+	names := suite.readdir(dir, 4096)
+	sort.Strings(names)
+	suite.Equal(expected, names)
+
+	// small enough to require several calls
+	names = suite.readdir(dir, 140)
+	sort.Strings(names)
+	suite.Equal(expected, names)
+
+	suite.ElementsMatch([]string{".", "..", "dir", "f"}, suite.readdir(root, 4096))
+}
+
+// readdirFrom makes one READDIR call, returning the fileids, names and
+// cookies of the entries
+func (suite *ServerSuite) readdirFrom(dir []byte, cookie uint64) ([]uint64, []string, []uint64) {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(dir)
+	args.PutUint64(cookie)
+	args.PutUint64(0)
+	args.PutUint32(4096)
+	res := suite.call(nfsProcReaddir, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipPostOpAttr(res)
+	res.GetUint64() // verifier
+	var ids, cookies []uint64
+	var names []string
+	for res.GetBool() {
+		ids = append(ids, res.GetUint64())
+		names = append(names, res.GetString(maxPathLen))
+		cookies = append(cookies, res.GetUint64())
+	}
+	res.GetBool() // eof
+	suite.Require().NoError(res.Err())
+	return ids, names, cookies
+}
+
+func (suite *ServerSuite) TestReaddirDots() {
+	root := suite.rootFh()
+	_, dir := suite.mkdir(root, "dir")
+	suite.create(dir, "foo", createGuarded)
+	rootI := suite.fs.RootInode()
+	dirI, _ := suite.fs.Lookup(rootI, "dir")
+
+	ids, names, cookies := suite.readdirFrom(dir, 0)
+	suite.Require().Len(names, 3)
+	suite.Equal([]string{".", "..", "foo"}, names)
+	suite.Equal([]uint64{dirI, rootI}, ids[:2])
+	suite.Equal([]uint64{1, 2}, cookies[:2])
+
+	_, names, _ = suite.readdirFrom(dir, 1)
+	suite.Equal([]string{"..", "foo"}, names)
+	_, names, _ = suite.readdirFrom(dir, 2)
+	suite.Equal([]string{"foo"}, names)
+	ids, _, _ = suite.readdirFrom(root, 0)
+	suite.Equal([]uint64{rootI, rootI}, ids[:2], "root should be its own parent")
+}
+
+func (suite *ServerSuite) TestReaddirPlus() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(root)
+	args.PutUint64(0)
+	args.PutUint64(0)
+	args.PutUint32(4096)
+	args.PutUint32(4096)
+	res := suite.call(nfsProcReaddirPlus, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipPostOpAttr(res)
+	res.GetUint64() // verifier
+	for _, e := range []struct {
+		name  string
+		ftype uint32
+		fh    []byte
+	}{
+		{".", nf3Dir, root},
+		{"..", nf3Dir, root},
+		{"foo", nf3Reg, fh},
+	} {
+		suite.Require().True(res.GetBool())
+		res.GetUint64() // fileid
+		suite.Equal(e.name, res.GetString(maxPathLen))
+		res.GetUint64() // cookie
+		suite.Require().True(res.GetBool(), "should have attributes")
+		ftype, _ := skipFattr(res)
+		suite.Equal(e.ftype, ftype)
+		suite.Require().True(res.GetBool(), "should have handle")
+		suite.Equal(e.fh, getFh(res))
+	}
+	suite.False(res.GetBool(), "should have only three entries")
+	suite.True(res.GetBool(), "should be at eof")
+	suite.NoError(res.Err())
+}
+
+func (suite *ServerSuite) TestRemove() {
+	root := suite.rootFh()
+	suite.create(root, "foo", createGuarded)
+	_, dir := suite.mkdir(root, "dir")
+	suite.create(dir, "bar", createGuarded)
+
+	res := suite.call(nfsProcRemove, dirOpArgs(root, "dir"))
+	suite.Equal(uint32(nfs.ErrIsDir), res.GetUint32())
+	res = suite.call(nfsProcRmdir, dirOpArgs(root, "foo"))
+	suite.Equal(uint32(nfs.ErrNotDir), res.GetUint32())
+	res = suite.call(nfsProcRmdir, dirOpArgs(root, "dir"))
+	suite.Equal(uint32(nfs.ErrNotEmpty), res.GetUint32())
+
+	res = suite.call(nfsProcRemove, dirOpArgs(root, "foo"))
+	suite.Equal(nfs3Ok, res.GetUint32())
+	stat, _ := suite.lookup(root, "foo")
+	suite.Equal(uint32(nfs.ErrNoEnt), stat)
+
+	res = suite.call(nfsProcRemove, dirOpArgs(dir, "bar"))
+	suite.Equal(nfs3Ok, res.GetUint32())
+	res = suite.call(nfsProcRmdir, dirOpArgs(root, "dir"))
+	suite.Equal(nfs3Ok, res.GetUint32())
+	suite.Equal([]string{".", ".."}, suite.readdir(root, 4096))
+}
+
+func (suite *ServerSuite) TestRename() {
+	root := suite.rootFh()
+	_, d1 := suite.mkdir(root, "d1")
+	_, d2 := suite.mkdir(root, "d2")
+	_, fh := suite.create(d1, "foo", createGuarded)
+
+	args := dirOpArgs(d1, "foo")
+	args.PutOpaque(d2)
+	args.PutString("bar")
+	res := suite.call(nfsProcRename, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipWcc(res)
+	skipWcc(res)
+	suite.NoError(res.Err())
+
+	stat, _ := suite.lookup(d1, "foo")
+	suite.Equal(uint32(nfs.ErrNoEnt), stat)
+	stat, fh2 := suite.lookup(d2, "bar")
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(fh, fh2)
+	stat, parent := suite.lookup(d2, "..")
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(root, parent)
+}
+
+func (suite *ServerSuite) TestLink() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	args.PutOpaque(root)
+	args.PutString("bar")
+	res := suite.call(nfsProcLink, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+
+	stat, fh2 := suite.lookup(root, "bar")
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(fh, fh2)
+	res = suite.call(nfsProcRemove, dirOpArgs(root, "foo"))
+	suite.Equal(nfs3Ok, res.GetUint32())
+	stat, _, _ = suite.getAttr(fh)
+	suite.Equal(nfs3Ok, stat, "file should still have a link")
+}
+
+func (suite *ServerSuite) TestSymlink() {
+	root := suite.rootFh()
+	args := dirOpArgs(root, "link")
+	for i := 0; i < 6; i++ {
+		args.PutUint32(0)
+	}
+	args.PutString("foo/bar")
+	res := suite.call(nfsProcSymlink, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	suite.Require().True(res.GetBool(), "should return handle")
+	fh := getFh(res)
+
+	stat, ftype, _ := suite.getAttr(fh)
+	suite.Equal(nfs3Ok, stat)
+	suite.Equal(nf3Lnk, ftype)
+
+	args = marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	res = suite.call(nfsProcReadlink, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipPostOpAttr(res)
+	suite.Equal("foo/bar", res.GetString(maxPathLen))
+	suite.NoError(res.Err())
+
+	args = marshal.NewXdrEnc()
+	args.PutOpaque(root)
+	res = suite.call(nfsProcReadlink, args)
+	suite.Equal(uint32(nfs.ErrInval), res.GetUint32())
+}
+
+// sizeSattr encodes a sattr3 that only sets the size
+func sizeSattr(args *marshal.XdrEnc, size uint64) {
+	args.PutBool(false) // mode
+	args.PutBool(false) // uid
+	args.PutBool(false) // gid
+	args.PutBool(true)
+	args.PutUint64(size)
+	args.PutUint32(dontChange) // atime
+	args.PutUint32(dontChange) // mtime
+}
+
+func (suite *ServerSuite) TestCreateBadAttrs() {
+	root := suite.rootFh()
+	// a directory or symlink has no size to set, so neither is created
+	args := dirOpArgs(root, "dir")
+	sizeSattr(args, 10)
+	res := suite.call(nfsProcMkdir, args)
+	suite.Equal(uint32(nfs.ErrIsDir), res.GetUint32())
+	stat, _ := suite.lookup(root, "dir")
+	suite.Equal(uint32(nfs.ErrNoEnt), stat, "failed MKDIR should be undone")
+
+	args = dirOpArgs(root, "link")
+	sizeSattr(args, 10)
+	args.PutString("foo")
+	res = suite.call(nfsProcSymlink, args)
+	suite.Equal(uint32(nfs.ErrInval), res.GetUint32())
+	stat, _ = suite.lookup(root, "link")
+	suite.Equal(uint32(nfs.ErrNoEnt), stat, "failed SYMLINK should be undone")
+}
+
+func (suite *ServerSuite) TestMknod() {
+	root := suite.rootFh()
+	args := dirOpArgs(root, "fifo")
+	args.PutUint32(nf3Fifo)
+	for i := 0; i < 6; i++ {
+		args.PutUint32(0)
+	}
+	res := suite.call(nfsProcMknod, args)
+	suite.Equal(uint32(nfs.ErrNotSupp), res.GetUint32())
+	suite.False(res.GetBool(), "pre_op_attr")
+	suite.False(res.GetBool(), "post_op_attr")
+	suite.NoError(res.Err())
+
+	args = dirOpArgs(root, "dev")
+	args.PutUint32(nf3Chr)
+	for i := 0; i < 6; i++ {
+		args.PutUint32(0)
+	}
+	args.PutUint32(1) // specdata1
+	args.PutUint32(3) // specdata2
+	res = suite.call(nfsProcMknod, args)
+	suite.Equal(uint32(nfs.ErrNotSupp), res.GetUint32())
+	stat, _ := suite.lookup(root, "dev")
+	suite.Equal(uint32(nfs.ErrNoEnt), stat)
+
+	args = dirOpArgs(root, "bad")
+	args.PutUint32(100)
+	stat, _, err := suite.c.rawCall(nfsProgram, nfsVersion, nfsProcMknod,
+		args.Finish())
+	suite.Require().NoError(err)
+	suite.Equal(acceptGarbageArgs, stat, "invalid ftype3")
+}
+
+func (suite *ServerSuite) TestSetAttr() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	args.PutBool(false) // mode
+	args.PutBool(false) // uid
+	args.PutBool(false) // gid
+	args.PutBool(true)
+	args.PutUint64(100)
+	args.PutUint32(setToServerTime)
+	args.PutUint32(dontChange)
+	args.PutBool(false) // guard
+	res := suite.call(nfsProcSetAttr, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	_, _, size := suite.getAttr(fh)
+	suite.Equal(uint64(100), size)
+
+	args = marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	for i := 0; i < 6; i++ {
+		args.PutUint32(0)
+	}
+	args.PutBool(true)
+	args.PutUint32(1)
+	args.PutUint32(0)
+	res = suite.call(nfsProcSetAttr, args)
+	suite.Equal(uint32(nfs.ErrNotSync), res.GetUint32())
+}
+
+// setSize sets the size of fh and returns the status
+func (suite *ServerSuite) setSize(fh []byte, size uint64) uint32 {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	sizeSattr(args, size)
+	args.PutBool(false) // guard
+	res := suite.call(nfsProcSetAttr, args)
+	stat := res.GetUint32()
+	skipWcc(res)
+	suite.Require().NoError(res.Err())
+	return stat
+}
+
+func (suite *ServerSuite) TestSetAttrTooLarge() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	suite.Equal(uint32(nfs.ErrFBig), suite.setSize(fh, 1<<64-1))
+	_, _, size := suite.getAttr(fh)
+	suite.Equal(uint64(0), size)
+}
+
+// write writes data to fh at off and returns the status and count written
+func (suite *ServerSuite) write(fh []byte, off uint64, data []byte) (uint32, uint32) {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	args.PutUint64(off)
+	args.PutUint32(uint32(len(data)))
+	args.PutUint32(fileSync)
+	args.PutOpaque(data)
+	res := suite.call(nfsProcWrite, args)
+	stat := res.GetUint32()
+	skipWcc(res)
+	if stat != nfs3Ok {
+		return stat, 0
+	}
+	count := res.GetUint32()
+	suite.Equal(fileSync, res.GetUint32())
+	res.GetFixedOpaque(nfs3WriteVerfSz)
+	suite.Require().NoError(res.Err())
+	return stat, count
+}
+
+func (suite *ServerSuite) TestWriteTooLarge() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	stat, _ := suite.write(fh, 1<<64-10, []byte("hello, world"))
+	suite.Equal(uint32(nfs.ErrFBig), stat)
+	_, _, size := suite.getAttr(fh)
+	suite.Equal(uint64(0), size)
+}
+
+// read reads up to count bytes from fh at off
+func (suite *ServerSuite) read(fh []byte, off uint64, count uint32) (uint32, []byte, bool) {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	args.PutUint64(off)
+	args.PutUint32(count)
+	res := suite.call(nfsProcRead, args)
+	stat := res.GetUint32()
+	skipPostOpAttr(res)
+	if stat != nfs3Ok {
+		return stat, nil, false
+	}
+	n := res.GetUint32()
+	eof := res.GetBool()
+	data := res.GetOpaque(maxIOSize)
+	suite.Require().NoError(res.Err())
+	suite.Equal(n, uint32(len(data)), "count should match the data")
+	return stat, data, eof
+}
+
+func (suite *ServerSuite) TestWriteRead() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	stat, count := suite.write(fh, 0, []byte("hello"))
+	suite.Require().Equal(nfs3Ok, stat)
+	suite.Equal(uint32(5), count)
+	stat, data, eof := suite.read(fh, 0, 100)
+	suite.Require().Equal(nfs3Ok, stat)
+	suite.Equal([]byte("hello"), data)
+	suite.True(eof)
+
+	// past the end, leaving a gap
+	stat, count = suite.write(fh, 4096+10, []byte("world"))
+	suite.Require().Equal(nfs3Ok, stat)
+	suite.Equal(uint32(5), count)
+	_, _, size := suite.getAttr(fh)
+	suite.Equal(uint64(4096+15), size)
+	expected := make([]byte, 4096+15)
+	copy(expected, "hello")
+	copy(expected[4096+10:], "world")
+	_, data, eof = suite.read(fh, 0, 8192)
+	suite.Equal(expected, data, "gap should read as zeros")
+	suite.True(eof)
+
+	_, data, eof = suite.read(fh, 1, 4)
+	suite.Equal([]byte("ello"), data)
+	suite.False(eof, "read should stop short of the end")
+	_, data, eof = suite.read(fh, 10000, 10)
+	suite.Empty(data)
+	suite.True(eof, "read past the end should be at eof")
+}
+
+func (suite *ServerSuite) TestSetAttrSize() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	suite.write(fh, 0, []byte("hello, world"))
+	suite.Require().Equal(nfs3Ok, suite.setSize(fh, 5))
+	_, _, size := suite.getAttr(fh)
+	suite.Equal(uint64(5), size)
+	_, data, _ := suite.read(fh, 0, 100)
+	suite.Equal([]byte("hello"), data)
+
+	suite.Require().Equal(nfs3Ok, suite.setSize(fh, 8192))
+	_, _, size = suite.getAttr(fh)
+	suite.Equal(uint64(8192), size)
+	_, data, eof := suite.read(fh, 0, 8192)
+	expected := make([]byte, 8192)
+	copy(expected, "hello")
+	suite.Equal(expected, data, "truncated data should not reappear")
+	suite.True(eof)
+}
+
+func (suite *ServerSuite) TestReadEmpty() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(fh)
+	args.PutUint64(0)
+	args.PutUint32(100)
+	res := suite.call(nfsProcRead, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipPostOpAttr(res)
+	suite.Equal(uint32(0), res.GetUint32())
+	suite.True(res.GetBool(), "should be at eof")
+	suite.Empty(res.GetOpaque(maxIOSize))
+	suite.NoError(res.Err())
+}
+
+func (suite *ServerSuite) TestFsStat() {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(suite.rootFh())
+	res := suite.call(nfsProcFsStat, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipPostOpAttr(res)
+	st := suite.fs.FsStat()
+	suite.Equal(st.TotalBytes, res.GetUint64())
+	suite.Equal(st.FreeBytes, res.GetUint64())
+	suite.Equal(st.AvailBytes, res.GetUint64())
+	suite.Equal(st.TotalFiles, res.GetUint64())
+	suite.Equal(st.FreeFiles, res.GetUint64())
+	suite.Equal(st.FreeFiles, res.GetUint64())
+	suite.Equal(uint32(0), res.GetUint32())
+	suite.NoError(res.Err())
+}
+
+func (suite *ServerSuite) TestFsInfo() {
+	args := marshal.NewXdrEnc()
+	args.PutOpaque(suite.rootFh())
+	res := suite.call(nfsProcFsInfo, args)
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	skipPostOpAttr(res)
+	info := suite.fs.FsInfo()
+	suite.Equal(uint32(info.MaxRead), res.GetUint32())
+	res.GetFixedOpaque(4 * 2) // rtpref, rtmult
+	suite.Equal(uint32(info.MaxWrite), res.GetUint32())
+	res.GetFixedOpaque(4 * 3) // wtpref, wtmult, dtpref
+	suite.Equal(info.MaxFileSize, res.GetUint64())
+	res.GetFixedOpaque(8) // time_delta
+	suite.Equal(fsf3Link|fsf3Symlink|fsf3Homogeneous|fsf3CanSetTime,
+		res.GetUint32())
+	suite.NoError(res.Err())
+}
+
+func (suite *ServerSuite) TestBadHandle() {
+	stat, _, _ := suite.getAttr([]byte{1, 2, 3})
+	suite.Equal(uint32(nfs.ErrBadHandle), stat)
+}
+
+func (suite *ServerSuite) TestStaleHandle() {
+	root := suite.rootFh()
+	_, fh := suite.create(root, "foo", createGuarded)
+	res := suite.call(nfsProcRemove, dirOpArgs(root, "foo"))
+	suite.Require().Equal(nfs3Ok, res.GetUint32())
+	stat, _, _ := suite.getAttr(fh)
+	suite.Equal(uint32(nfs.ErrStale), stat)
+
+	// a new file with the same inode number
+	_, fh2 := suite.create(root, "bar", createGuarded)
+	stat, _, _ = suite.getAttr(fh)
+	suite.Equal(uint32(nfs.ErrStale), stat)
+	stat, _, _ = suite.getAttr(fh2)
+	suite.Equal(nfs3Ok, stat)
+}
+
+func (suite *ServerSuite) TestGarbageArgs() {
+	stat, _, err := suite.c.rawCall(nfsProgram, nfsVersion, nfsProcLookup,
+		[]byte{0, 0, 0, 8})
+	suite.Require().NoError(err)
+	suite.Equal(acceptGarbageArgs, stat)
+}
+
+func (suite *ServerSuite) TestUnavailable() {
+	stat, _, err := suite.c.rawCall(nfsProgram+1, nfsVersion, nfsProcNull, nil)
+	suite.Require().NoError(err)
+	suite.Equal(acceptProgUnavail, stat)
+	stat, _, err = suite.c.rawCall(nfsProgram, 2, nfsProcNull, nil)
+	suite.Require().NoError(err)
+	suite.Equal(acceptProgMismatch, stat)
+	stat, _, err = suite.c.rawCall(nfsProgram, nfsVersion, 100, nil)
+	suite.Require().NoError(err)
+	suite.Equal(acceptProcUnavail, stat)
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerSuite))
+}
@@ -0,0 +1,451 @@
+package nfs
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/tchajed/go-nfs/lockmap"
+)
+
+// MaxTxnBlocks is the most blocks a transaction can write, since the log
+// commits each transaction in one operation
+const MaxTxnBlocks = disk.BlockSize/8 - 1
+
+// ErrTxnTooBig means an operation would make its transaction write more than
+// MaxTxnBlocks blocks, so the operation failed instead
+var ErrTxnTooBig = errors.New("transaction is too large to commit")
+
+// txn is a file-system operation in progress
+//
+// Writes are buffered here until Commit, so that reads within the operation
+// observe them and so that an operation that fails can simply be dropped.
+// Allocator bitmaps are the exception: they are changed in place (under the
+// allocator lock), and the txn keeps the changes so it can undo them.
+//
+// A txn also holds locks until it finishes: an inode's lock protects the
+// inode and its blocks, the allocator lock protects the bitmaps, and the
+// rename lock keeps directories from moving (so that Rename can check for
+// loops).
+type txn struct {
+	log   Log
+	locks *lockmap.LockMap
+	// for a nested operation, the transaction it is part of
+	parent *txn
+	blocks map[uint64]disk.Block
+	// allocator changes, in order
+	allocChanges []allocChange
+	// addresses of the bitmap blocks changed, which are written at commit
+	bitmaps map[uint64]*allocator
+	// keys locked by this transaction (and not its parent)
+	held []uint64
+	// after lock returns errRetry, the key that could not be locked
+	wanted uint64
+}
+
+// locks are acquired in order of their keys; inode locks are keyed by Inum,
+// between the rename lock and the allocator lock
+const renameLock uint64 = 0
+const allocLock uint64 = 1<<64 - 1
+
+// errRetry means an operation could not take a lock in order, and should be
+// restarted with that lock taken up front
+var errRetry = errors.New("lock acquired out of order")
+
+func (fs Fs) begin() *txn {
+	return &txn{
+		log:     fs.log,
+		locks:   fs.locks,
+		blocks:  make(map[uint64]disk.Block),
+		bitmaps: make(map[uint64]*allocator),
+	}
+}
+
+// nested starts an operation within parent, whose writes are added to
+// parent only if it commits
+func (parent *txn) nested() *txn {
+	return &txn{
+		log:     parent.log,
+		locks:   parent.locks,
+		parent:  parent,
+		blocks:  make(map[uint64]disk.Block),
+		bitmaps: make(map[uint64]*allocator),
+	}
+}
+
+func (txn *txn) holds(k uint64) bool {
+	for t := txn; t != nil; t = t.parent {
+		for _, h := range t.held {
+			if h == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lock locks k until the transaction finishes
+//
+// To avoid deadlock, lock only waits for k if it is above every key already
+// held. Otherwise, if k is taken, lock returns errRetry, which the operation
+// should return so it can be restarted with k locked up front.
+func (txn *txn) lock(k uint64) error {
+	if txn.holds(k) {
+		return nil
+	}
+	inOrder := true
+	for t := txn; t != nil; t = t.parent {
+		for _, h := range t.held {
+			if h > k {
+				inOrder = false
+			}
+		}
+	}
+	if inOrder {
+		txn.locks.Acquire(k)
+	} else if !txn.locks.TryAcquire(k) {
+		txn.wanted = k
+		return errRetry
+	}
+	txn.held = append(txn.held, k)
+	return nil
+}
+
+// lockInodes locks several inodes, in order
+func (txn *txn) lockInodes(is ...Inum) error {
+	sorted := append([]Inum{}, is...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, i := range sorted {
+		if err := txn.lock(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockAlloc locks the allocator, which is last in the lock order and so
+// never needs a restart
+func (txn *txn) lockAlloc() {
+	if err := txn.lock(allocLock); err != nil {
+		panic("allocator lock is out of order")
+	}
+}
+
+// release unlocks everything locked by txn (but not its parent)
+func (txn *txn) release() {
+	for _, k := range txn.held {
+		txn.locks.Release(k)
+	}
+	txn.held = nil
+}
+
+// abort undoes txn's allocator changes (but not its parent's) and releases
+// its locks
+//
+// txn's writes are simply dropped
+func (txn *txn) abort() {
+	for k := len(txn.allocChanges) - 1; k >= 0; k-- {
+		txn.allocChanges[k].undo()
+	}
+	txn.allocChanges = nil
+	txn.release()
+}
+
+// Read returns the contents of block a as of this transaction
+//
+// the caller owns the returned block and can modify it
+func (txn *txn) Read(a uint64) disk.Block {
+	if b, ok := txn.blocks[a]; ok {
+		return append(disk.Block{}, b...)
+	}
+	if txn.parent != nil {
+		return txn.parent.Read(a)
+	}
+	return txn.log.Read(a)
+}
+
+// ReadRange is like Read for the n blocks starting at a, reading any that
+// txn has not written from the log in one request
+func (txn *txn) ReadRange(a uint64, n uint64) []disk.Block {
+	var bs []disk.Block
+	if txn.parent != nil {
+		bs = txn.parent.ReadRange(a, n)
+	} else {
+		bs = readRange(txn.log, a, n)
+	}
+	for k := range bs {
+		if b, ok := txn.blocks[a+uint64(k)]; ok {
+			bs[k] = append(disk.Block{}, b...)
+		}
+	}
+	return bs
+}
+
+func (txn *txn) Write(a uint64, b disk.Block) {
+	txn.blocks[a] = append(disk.Block{}, b...)
+}
+
+// numBlocks is the number of distinct blocks written by txn and the
+// transactions it is nested in
+func (txn *txn) numBlocks() uint64 {
+	written := make(map[uint64]bool)
+	for t := txn; t != nil; t = t.parent {
+		for a := range t.blocks {
+			written[a] = true
+		}
+		for a := range t.bitmaps {
+			written[a] = true
+		}
+	}
+	return uint64(len(written))
+}
+
+// Commit atomically applies the transaction's writes and releases its locks
+//
+// for a nested operation, the writes and locks instead become part of the
+// parent
+func (txn *txn) Commit() {
+	if txn.parent != nil {
+		for a, b := range txn.blocks {
+			txn.parent.blocks[a] = b
+		}
+		for a, alloc := range txn.bitmaps {
+			txn.parent.bitmaps[a] = alloc
+		}
+		txn.parent.allocChanges = append(txn.parent.allocChanges,
+			txn.allocChanges...)
+		txn.parent.held = append(txn.parent.held, txn.held...)
+		txn.held = nil
+		return
+	}
+	if len(txn.blocks) != 0 || len(txn.bitmaps) != 0 {
+		op := txn.log.Begin()
+		for a, b := range txn.blocks {
+			op.Write(a, b)
+		}
+		for a, alloc := range txn.bitmaps {
+			// later transactions change the bitmap in place
+			op.Write(a, append(disk.Block{}, alloc.block(a)...))
+		}
+		txn.log.Commit(op)
+	}
+	txn.release()
+}
+
+// Txn is a batch of file-system operations that commit atomically
+//
+// Operations in a Txn observe the effects of earlier ones in the batch. An
+// operation that returns an error has no effect, and the batch can carry on
+// with other operations. Nothing is written until Commit, so a crash (or
+// Abort) before then discards the whole batch.
+//
+// A Txn keeps the inodes it uses locked until it finishes, which isolates it
+// from concurrent operations. A Txn only waits for a lock above every one it
+// already holds, so Txns never deadlock. In a batch, an operation that needs
+// a lock out of that order (below one the batch already holds) and cannot
+// take it right away fails with ErrJukebox instead; the caller should then
+// Abort the batch, releasing its locks, and retry it from the start. A Txn
+// itself must only be used by one goroutine.
+//
+// The log commits a Txn in one operation, so together its operations can
+// write at most MaxTxnBlocks blocks (counting data, inode, directory,
+// indirect and allocator blocks); an operation that would go over fails with
+// ErrTxnTooBig. Fs.Write splits large writes so they fit, and truncating or
+// removing a large file through Fs frees its blocks a piece at a time (see
+// PrepareRemove), but the Txn methods do not.
+//
+// Otherwise, the Fs methods are each a Txn of a single operation.
+type Txn struct {
+	fs  Fs
+	txn *txn
+	// after an attempt returns errRetry, what to lock on the next one
+	retry []uint64
+}
+
+// Begin starts a new transaction
+func (fs Fs) Begin() *Txn {
+	return &Txn{fs: fs, txn: fs.begin()}
+}
+
+func (t *Txn) check() {
+	if t.txn == nil {
+		panic("transaction is already finished")
+	}
+}
+
+// Commit atomically applies all of the operations in t
+func (t *Txn) Commit() {
+	t.check()
+	t.txn.Commit()
+	t.txn = nil
+}
+
+// Abort discards all of the operations in t
+func (t *Txn) Abort() {
+	t.check()
+	t.txn.abort()
+	t.txn = nil
+}
+
+// do runs an operation as part of t, which has no effect if it fails
+//
+// returns ErrTxnTooBig if the operation would make t too large to commit
+func (t *Txn) do(op func(txn *txn) error) error {
+	t.check()
+	var prelock []uint64
+	for {
+		err := t.try(op, prelock)
+		if err != errRetry {
+			return err
+		}
+		prelock = t.retry
+	}
+}
+
+// try runs one attempt at an operation, after locking the keys in prelock
+//
+// if the operation needs to restart, returns errRetry and sets t.retry to
+// the keys to lock up front next time; returns ErrJukebox if a key in
+// prelock cannot be locked without risking deadlock
+func (t *Txn) try(op func(txn *txn) error, prelock []uint64) error {
+	txn := t.txn.nested()
+	committed := false
+	defer func() {
+		// also runs if op panics
+		if !committed {
+			txn.abort()
+		}
+	}()
+	sort.Slice(prelock, func(i, j int) bool { return prelock[i] < prelock[j] })
+	for _, k := range prelock {
+		// waits only for keys above those already held, by this attempt or
+		// by earlier operations in the batch
+		if err := txn.lock(k); err != nil {
+			return ErrJukebox
+		}
+	}
+	if err := op(txn); err != nil {
+		if err == errRetry {
+			t.retry = append(append([]uint64{}, txn.held...), txn.wanted)
+		}
+		return err
+	}
+	if txn.numBlocks() > MaxTxnBlocks {
+		return ErrTxnTooBig
+	}
+	txn.Commit()
+	committed = true
+	return nil
+}
+
+// Lookup is like Fs.Lookup, as part of t
+func (t *Txn) Lookup(i Inum, name string) (Inum, error) {
+	var child Inum
+	err := t.do(func(txn *txn) error {
+		var err error
+		child, err = t.fs.lookup(txn, i, name)
+		return err
+	})
+	return child, err
+}
+
+// GetAttr is like Fs.GetAttr, as part of t
+func (t *Txn) GetAttr(i Inum) (Attr, error) {
+	var attr Attr
+	err := t.do(func(txn *txn) error {
+		var err error
+		attr, err = t.fs.getAttr(txn, i)
+		return err
+	})
+	return attr, err
+}
+
+// SetAttr is like Fs.SetAttr, as part of t
+func (t *Txn) SetAttr(i Inum, attrs SetAttrs, guard *Time) error {
+	return t.do(func(txn *txn) error {
+		return t.fs.setAttr(txn, i, attrs, guard)
+	})
+}
+
+// Create is like Fs.Create, as part of t
+func (t *Txn) Create(dirI Inum, name string, unchecked bool) (Inum, error) {
+	var i Inum
+	err := t.do(func(txn *txn) error {
+		var err error
+		i, err = t.fs.create(txn, dirI, name, unchecked)
+		return err
+	})
+	return i, err
+}
+
+// Mkdir is like Fs.Mkdir, as part of t
+func (t *Txn) Mkdir(dirI Inum, name string) (Inum, error) {
+	var i Inum
+	err := t.do(func(txn *txn) error {
+		var err error
+		i, err = t.fs.mkdir(txn, dirI, name)
+		return err
+	})
+	return i, err
+}
+
+// Symlink is like Fs.Symlink, as part of t
+func (t *Txn) Symlink(dirI Inum, name string, target string) (Inum, error) {
+	var i Inum
+	err := t.do(func(txn *txn) error {
+		var err error
+		i, err = t.fs.symlink(txn, dirI, name, target)
+		return err
+	})
+	return i, err
+}
+
+// Readlink is like Fs.Readlink, as part of t
+func (t *Txn) Readlink(i Inum) (string, error) {
+	var target string
+	err := t.do(func(txn *txn) error {
+		var err error
+		target, err = t.fs.readlink(txn, i)
+		return err
+	})
+	return target, err
+}
+
+// Read is like Fs.Read, as part of t
+func (t *Txn) Read(i Inum, off uint64, length uint64) (data []byte, eof bool, err error) {
+	err = t.do(func(txn *txn) error {
+		var err error
+		data, eof, err = t.fs.read(txn, i, off, length)
+		return err
+	})
+	return
+}
+
+// Write is like Fs.Write, as part of t
+func (t *Txn) Write(i Inum, off uint64, bs []byte) error {
+	return t.do(func(txn *txn) error {
+		return t.fs.write(txn, i, off, bs)
+	})
+}
+
+// Remove is like Fs.Remove, as part of t
+func (t *Txn) Remove(dirI Inum, name string) error {
+	return t.do(func(txn *txn) error {
+		return t.fs.remove(txn, dirI, name)
+	})
+}
+
+// Link is like Fs.Link, as part of t
+func (t *Txn) Link(i Inum, dirI Inum, name string) error {
+	return t.do(func(txn *txn) error {
+		return t.fs.link(txn, i, dirI, name)
+	})
+}
+
+// Rename is like Fs.Rename, as part of t
+func (t *Txn) Rename(srcDirI Inum, srcName string, dstDirI Inum, dstName string) error {
+	return t.do(func(txn *txn) error {
+		return t.fs.rename(txn, srcDirI, srcName, dstDirI, dstName)
+	})
+}